@@ -1,533 +1,572 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
-	"embed"
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/fs"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
-	"strconv"
+	"os"
+	"os/signal"
+	"regexp"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
-	"unicode/utf8"
-)
 
-const (
-	defaultLogLimit = 1000
-	maxBodyLogSize  = 64 * 1024
+	"proxymystuff/proxy"
 )
 
-//go:embed web/*
-var webAssets embed.FS
-
 func main() {
 	var listenAddr string
 	var defaultTarget string
 	var logLimit int
-
-	flag.StringVar(&listenAddr, "listen", ":8080", "address to listen on")
-	flag.StringVar(&defaultTarget, "default-target", "", "default target base URL for proxying")
-	flag.IntVar(&logLimit, "log-limit", defaultLogLimit, "maximum number of log entries to retain")
+	var trustedProxies string
+	var upstreamProxy string
+	var retries int
+	var allowMethods string
+	var captureBodyMethods string
+	var maxIdleConns int
+	var maxConnsPerHost int
+	var logFormat string
+	var logPathFilter string
+	var logExclude stringList
+	var responseRewrites stringList
+	var rewriteRedirects bool
+	var rewriteCookies bool
+	var normalizePath bool
+	var maxTotalBodyBytes int64
+	var keepHeaders string
+	var coalesce bool
+	var sampleRate float64
+	var noUI bool
+	var breakerThreshold int
+	var maxConcurrency int
+	var breakPath string
+	var breakTimeout time.Duration
+	var queueTimeout time.Duration
+	var breakerCooldown time.Duration
+	var corsOrigin string
+	var hostRoutes stringList
+	var omitBinary bool
+	var binaryTypes string
+	var mockFile string
+	var maxRequestSize int64
+	var throttleBPS int64
+	var throttleLatency time.Duration
+	var respectRetryAfter bool
+	var detectLoops bool
+	var userAgent string
+	var cookieJar bool
+	var cacheMode string
+	var cacheFile string
+	var cassetteMode string
+	var cassetteFile string
+	var httpCache bool
+	var logEvictions bool
+	var logMaxAge time.Duration
+	var schemas stringList
+	var targetSecret string
+	var redactBodyKeys string
+	var sortJSONKeys bool
+	var bodyDir string
+	var bodyFileThreshold int
+	var captureTLS bool
+	var insecure bool
+	var clientCert string
+	var clientKey string
+	var verbosePath string
+	var verboseBodyLimit int
+	var forceStatuses stringList
+	var delays stringList
+	var requestPatches stringList
+	var uiDir string
+	var compactJSON bool
+	var webhookURL string
+	var sessionHeader string
+	var sessionCookie string
+	var targetHeaders stringList
+	var rawHeaderCase bool
+	var idleTimeout time.Duration
+	var readTimeout time.Duration
+
+	flag.StringVar(&listenAddr, "listen", ":8080", "address to listen on, or unix:/path/to/socket for a Unix domain socket")
+	flag.StringVar(&defaultTarget, "default-target", "", "default target base URL for proxying; a comma-separated list fails over in order")
+	flag.IntVar(&logLimit, "log-limit", proxy.DefaultLogLimit, "maximum number of log entries to retain")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "comma-separated CIDR ranges whose X-Forwarded-For/X-Real-IP headers are trusted")
+	flag.StringVar(&upstreamProxy, "upstream-proxy", "", "route proxied requests through an upstream proxy (http://, https:// or socks5:// URL)")
+	flag.IntVar(&retries, "retry", 0, "number of times to retry idempotent requests on upstream connection failure")
+	flag.StringVar(&allowMethods, "allow-methods", "", "comma-separated list of HTTP methods to proxy (default all)")
+	flag.StringVar(&captureBodyMethods, "capture-body-methods", "", "comma-separated list of HTTP methods whose request bodies are captured, e.g. POST,PUT,PATCH (default all)")
+	flag.IntVar(&maxIdleConns, "max-idle-conns", 100, "maximum idle upstream connections kept in the pool, also applied per host")
+	flag.IntVar(&maxConnsPerHost, "max-conns-per-host", 0, "maximum upstream connections per target host (0 means unlimited)")
+	flag.StringVar(&logFormat, "log-format", "text", "access log format: text or json")
+	flag.DurationVar(&logMaxAge, "log-max-age", 0, "drop log entries older than this, e.g. 1h (0 keeps them regardless of age)")
+	flag.BoolVar(&logEvictions, "log-evictions", true, "log a line for each entry dropped because the log limit was reached; -log-evictions=false turns it off")
+	flag.StringVar(&logPathFilter, "log-path-filter", "", "only log requests whose path matches this regular expression")
+	flag.Var(&logExclude, "log-exclude", "skip logging requests whose path matches this regular expression (repeatable)")
+	flag.Var(&responseRewrites, "response-rewrite", "search=replace pair applied to text response bodies (repeatable)")
+	flag.BoolVar(&rewriteRedirects, "rewrite-redirects", false, "rewrite Location headers pointing at the target to go through the proxy")
+	flag.BoolVar(&rewriteCookies, "rewrite-cookies", false, "rewrite Set-Cookie Domain and Path attributes so cookies work through the proxy")
+	flag.BoolVar(&normalizePath, "normalize-path", false, "collapse repeated slashes and resolve . and .. segments in upstream request paths")
+	flag.Int64Var(&maxTotalBodyBytes, "max-total-body-bytes", 0, "cap on the combined size of stored bodies; oldest bodies are dropped first (0 means unlimited)")
+	flag.StringVar(&keepHeaders, "keep-headers", "", "comma-separated hop-by-hop headers to forward to the target anyway")
+	flag.BoolVar(&coalesce, "coalesce", false, "share one upstream call between identical concurrent GET requests")
+	flag.Float64Var(&sampleRate, "sample-rate", 1, "fraction of requests (0.0-1.0) whose bodies are captured; others log metadata only")
+	flag.BoolVar(&noUI, "no-ui", false, "disable the web UI and /api routes, exposing only the proxy and health checks")
+	flag.IntVar(&maxConcurrency, "max-concurrency", 0, "maximum number of requests forwarded to targets at once (0 means unlimited)")
+	flag.DurationVar(&queueTimeout, "queue-timeout", 0, "how long a request waits for a -max-concurrency slot before getting a 503 (0 rejects at once)")
+	flag.StringVar(&breakPath, "break-path", "", "hold requests whose path matches this regular expression until they are continued with POST /api/breakpoints/{id}/continue")
+	flag.DurationVar(&breakTimeout, "break-timeout", 5*time.Minute, "forward a request held by -break-path unchanged after this long (0 waits indefinitely)")
+	flag.IntVar(&breakerThreshold, "breaker-threshold", 0, "consecutive failures after which requests to a target host are rejected with 503 (0 disables)")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "how long an open circuit breaker rejects requests before probing the host again")
+	flag.StringVar(&corsOrigin, "cors-origin", "", "comma-separated origins allowed to call the /api routes cross-origin, or * for any")
+	flag.Var(&hostRoutes, "host-route", "name=target route for requests whose Host starts with name, e.g. api=https://api.example.com (repeatable)")
+	flag.BoolVar(&omitBinary, "omit-binary", false, "store a size placeholder instead of the body for binary responses")
+	flag.StringVar(&binaryTypes, "binary-types", proxy.DefaultOmitBodyTypes, "comma-separated content types treated as binary by -omit-binary; type/* matches a whole type")
+	flag.StringVar(&mockFile, "mocks", "", "JSON file of mock responses served instead of proxying; bodies may use templates such as {{.Query.name}}")
+	flag.Int64Var(&maxRequestSize, "max-request-size", 0, "reject requests whose body exceeds this many bytes with 413 (0 means unlimited)")
+	flag.Int64Var(&throttleBPS, "throttle-bps", 0, "limit response bodies sent to clients to this many bytes per second (0 means unlimited)")
+	flag.DurationVar(&throttleLatency, "throttle-latency", 0, "delay every response by this long before its first byte")
+	flag.BoolVar(&respectRetryAfter, "respect-retry-after", false, "retry a 429 response once after waiting for its Retry-After delay (up to 30s)")
+	flag.BoolVar(&detectLoops, "detect-loops", false, "tag forwarded requests with an X-Proxymystuff-Instance header and reject requests that loop back to this proxy")
+	flag.StringVar(&userAgent, "user-agent", "", "replace the User-Agent sent to targets; an explicitly empty value removes it")
+	flag.BoolVar(&cookieJar, "cookie-jar", false, "keep cookies set by targets per client IP and send them on later requests")
+	flag.StringVar(&cacheMode, "cache-mode", "", "record responses to -cache-file, or replay them from it without contacting targets (record or replay)")
+	flag.StringVar(&cacheFile, "cache-file", "proxymystuff-cache.json", "file the -cache-mode response cache is stored in")
+	flag.StringVar(&cassetteMode, "cassette-mode", "", "record interactions to the -cassette YAML file, or replay them from it (record or replay)")
+	flag.StringVar(&cassetteFile, "cassette", "cassette.yaml", "YAML file the -cassette-mode interactions are stored in")
+	flag.BoolVar(&httpCache, "cache", false, "cache GET responses in memory for as long as their Cache-Control max-age or Expires headers allow")
+	flag.Var(&schemas, "schema", "pattern=file validating JSON responses for paths matching the regular expression against a JSON Schema (repeatable)")
+	flag.StringVar(&targetSecret, "target-secret", "", "require client-chosen targets to be signed with an HMAC-SHA256 of this secret in X-Proxy-Target-Signature")
+	flag.StringVar(&redactBodyKeys, "redact-body-keys", "", "comma-separated JSON keys whose values are stored as *** in captured bodies")
+	flag.BoolVar(&sortJSONKeys, "sort-json-keys", false, "store captured JSON bodies re-serialized with sorted keys, so bodies that differ only in key order compare equal")
+	flag.StringVar(&bodyDir, "body-dir", "", "write bodies larger than -body-file-threshold in full to files in this directory instead of keeping them in memory")
+	flag.IntVar(&bodyFileThreshold, "body-file-threshold", proxy.DefaultMaxBodyLogSize, "size in bytes above which -body-dir stores a body in a file")
+	flag.BoolVar(&captureTLS, "capture-tls", false, "record the certificate chain presented by HTTPS targets on each entry")
+	flag.BoolVar(&insecure, "insecure", false, "skip verification of target TLS certificates (for self-signed dev backends only)")
+	flag.StringVar(&clientCert, "client-cert", "", "PEM certificate presented to targets that require mutual TLS (needs -client-key)")
+	flag.StringVar(&clientKey, "client-key", "", "PEM private key for -client-cert")
+	flag.StringVar(&verbosePath, "verbose-path", "", "capture bodies up to -verbose-body-limit for requests whose path matches this regular expression")
+	flag.IntVar(&verboseBodyLimit, "verbose-body-limit", proxy.DefaultVerboseBodyLimit, "body capture limit in bytes for -verbose-path requests")
+	flag.Var(&delays, "delay", "pattern=duration holding requests for paths matching the regular expression before forwarding them, e.g. ^/api/slow=2s (repeatable)")
+	flag.Var(&forceStatuses, "force-status", "pattern=status replacing the status of responses for paths matching the regular expression; append :empty to also drop the body (repeatable)")
+	flag.Var(&requestPatches, "request-patch", `pattern={json} merge patch applied to JSON request bodies for paths matching the regular expression, e.g. ^/orders={"debug":true} (repeatable)`)
+	flag.StringVar(&uiDir, "ui-dir", "", "serve the web UI from this directory instead of the embedded assets, for UI development")
+	flag.BoolVar(&compactJSON, "compact-json", false, "return compact JSON from /api routes unless ?indent=true is passed")
+	flag.StringVar(&webhookURL, "webhook-url", "", "POST each completed exchange as JSON to this URL in the background")
+	flag.Var(&targetHeaders, "target-header", `host=Name: value header added to requests forwarded to the target host, e.g. api.example.com=Authorization: Bearer x (repeatable)`)
+	flag.DurationVar(&idleTimeout, "idle-timeout", defaultIdleTimeout, "close idle keep-alive client connections after this long (0 uses -read-timeout)")
+	flag.DurationVar(&readTimeout, "read-timeout", 0, "maximum time to read a whole client request, including its body (0 means unlimited)")
+	flag.BoolVar(&rawHeaderCase, "raw-header-case", false, "record request header names as the client sent them instead of in canonical form")
+	flag.StringVar(&sessionHeader, "session-header", "X-Session-Id", "request header that groups entries into sessions")
+	flag.StringVar(&sessionCookie, "session-cookie", "", "cookie that groups entries into sessions when the session header is absent")
 	flag.Parse()
 
-	var defaultTargetURL *url.URL
-	if defaultTarget != "" {
-		parsed, err := url.Parse(defaultTarget)
-		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
-			log.Fatalf("invalid default target: %s", defaultTarget)
-		}
-		defaultTargetURL = parsed
+	if sampleRate < 0 || sampleRate > 1 {
+		log.Fatalf("invalid sample rate: %v", sampleRate)
 	}
 
-	store := NewLogStore(logLimit)
-	resolver := &TargetResolver{DefaultTarget: defaultTargetURL}
-
-	webFS, err := fs.Sub(webAssets, "web")
-	if err != nil {
-		log.Fatalf("failed to load embedded assets: %v", err)
+	if cacheMode != "" && cacheMode != "record" && cacheMode != "replay" {
+		log.Fatalf("invalid cache mode: %s", cacheMode)
+	}
+	if cassetteMode != "" && cassetteMode != "record" && cassetteMode != "replay" {
+		log.Fatalf("invalid cassette mode: %s", cassetteMode)
+	}
+	if cacheMode != "" && cassetteMode != "" {
+		log.Fatal("-cache-mode and -cassette-mode cannot be combined")
 	}
 
-	mux := http.NewServeMux()
-	mux.Handle("/ui/", http.StripPrefix("/ui/", http.FileServer(http.FS(webFS))))
-	mux.HandleFunc("/ui", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/ui/", http.StatusFound)
-	})
-	mux.HandleFunc("/api/logs", handleListLogs(store))
-	mux.HandleFunc("/api/logs/", handleGetLog(store))
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
-	})
-
-	proxy := &ProxyHandler{Store: store, Resolver: resolver}
-	mux.Handle("/", proxy)
-
-	server := &http.Server{
-		Addr:              listenAddr,
-		Handler:           loggingMiddleware(mux),
-		ReadHeaderTimeout: 5 * time.Second,
+	if logFormat != "text" && logFormat != "json" {
+		log.Fatalf("invalid log format: %s", logFormat)
 	}
 
-	log.Printf("listening on %s", listenAddr)
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatalf("server error: %v", err)
+	var defaultTargetURL *url.URL
+	var fallbackTargetURLs []*url.URL
+	if defaultTarget != "" {
+		for _, value := range proxy.SplitTargetList(defaultTarget) {
+			parsed, err := url.Parse(value)
+			if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+				log.Fatalf("invalid default target: %s", value)
+			}
+			if defaultTargetURL == nil {
+				defaultTargetURL = parsed
+			} else {
+				fallbackTargetURLs = append(fallbackTargetURLs, parsed)
+			}
+		}
 	}
-}
 
-type TargetResolver struct {
-	DefaultTarget *url.URL
-}
+	corsOrigins := proxy.ParseOriginList(corsOrigin)
 
-func (r *TargetResolver) Resolve(req *http.Request) (*url.URL, bool, error) {
-	if target := req.Header.Get("X-Proxy-Target"); target != "" {
-		return parseTarget(target, req, true)
+	trustedNets, err := proxy.ParseCIDRList(trustedProxies)
+	if err != nil {
+		log.Fatalf("invalid trusted proxies: %v", err)
 	}
 
-	query := req.URL.Query()
-	if target := query.Get("target"); target != "" {
-		query.Del("target")
-		req.URL.RawQuery = query.Encode()
-		return parseTarget(target, req, true)
+	// The clone keeps HTTP/2 for TLS targets. Go's HTTP/2 client disables
+	// server push, so targets never send push promises.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	transport.MaxConnsPerHost = maxConnsPerHost
+	if insecure {
+		log.Printf("WARNING: -insecure is set; target TLS certificates will NOT be verified")
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
-
-	if strings.HasPrefix(req.URL.Path, "/proxy/") {
-		trimmed := strings.TrimPrefix(req.URL.Path, "/proxy/")
-		decoded, err := url.PathUnescape(trimmed)
+	if clientCert != "" || clientKey != "" {
+		cert, err := proxy.LoadClientCertificate(clientCert, clientKey)
 		if err != nil {
-			return nil, false, fmt.Errorf("invalid proxy path: %w", err)
+			log.Fatalf("invalid client certificate: %v", err)
 		}
-		return parseTarget(decoded, req, false)
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
 	}
-
-	if r.DefaultTarget != nil {
-		return parseTarget(r.DefaultTarget.String(), req, true)
+	var upstreamProxyURL *url.URL
+	if upstreamProxy != "" {
+		upstreamProxyURL, err = proxy.ParseUpstreamProxy(upstreamProxy)
+		if err != nil {
+			log.Fatalf("invalid upstream proxy: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(upstreamProxyURL)
 	}
 
-	return nil, false, errors.New("no target specified")
-}
+	handler := proxy.New(proxy.Options{
+		LogLimit:          logLimit,
+		MaxTotalBodyBytes: maxTotalBodyBytes,
+		MaxRequestSize:    maxRequestSize,
+		RedactBodyKeys:    strings.Split(redactBodyKeys, ","),
+		DefaultTarget:     defaultTargetURL,
+		FallbackTargets:   fallbackTargetURLs,
+		Transport:         transport,
+	})
 
-func parseTarget(target string, req *http.Request, useRequestPath bool) (*url.URL, bool, error) {
-	parsed, err := url.Parse(target)
-	if err != nil {
-		return nil, false, fmt.Errorf("invalid target: %w", err)
+	store := handler.Store
+	store.TrustedProxies = trustedNets
+	store.MaxAge = logMaxAge
+	if omitBinary {
+		store.OmitBodyTypes = proxy.ParseContentTypeList(binaryTypes)
 	}
-	if parsed.Scheme == "" || parsed.Host == "" {
-		return nil, false, errors.New("target must include scheme and host")
+	store.SortJSONKeys = sortJSONKeys
+	if bodyDir != "" {
+		if err := os.MkdirAll(bodyDir, 0o700); err != nil {
+			log.Fatalf("invalid body dir: %v", err)
+		}
+		store.BodyDir = bodyDir
+		store.BodyFileThreshold = bodyFileThreshold
+	}
+	store.SessionHeader = sessionHeader
+	store.RawHeaderCase = rawHeaderCase
+	if logEvictions {
+		store.OnEvict = proxy.LogEviction
+	}
+	store.SessionCookie = sessionCookie
+	if webhookURL != "" {
+		parsed, err := url.Parse(webhookURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			log.Fatalf("invalid webhook URL: %s", webhookURL)
+		}
+		store.Webhook = proxy.NewWebhook(webhookURL)
 	}
-	return parsed, useRequestPath, nil
-}
-
-type ProxyHandler struct {
-	Store    *LogStore
-	Resolver *TargetResolver
-}
-
-func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	entry := h.Store.NewEntry(r)
-
-	target, useRequestPath, err := h.Resolver.Resolve(r)
-	if err != nil {
-		entry.SetError(err.Error())
-		entry.SetDurationSinceStart()
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if logPathFilter != "" {
+		pattern, err := regexp.Compile(logPathFilter)
+		if err != nil {
+			log.Fatalf("invalid log path filter: %v", err)
+		}
+		store.PathFilter = pattern
 	}
-
-	requestBody, err := io.ReadAll(r.Body)
-	if err != nil {
-		entry.SetError(fmt.Sprintf("read request body: %v", err))
-		entry.SetDurationSinceStart()
-		http.Error(w, "failed to read request body", http.StatusBadRequest)
-		return
-	}
-	_ = r.Body.Close()
-	entry.SetRequestBody(requestBody)
-	r.Body = io.NopCloser(bytes.NewReader(requestBody))
-
-	proxy := &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			req.URL.Scheme = target.Scheme
-			req.URL.Host = target.Host
-
-			if useRequestPath {
-				rawQuery := req.URL.RawQuery
-				if target.RawQuery != "" {
-					if rawQuery != "" {
-						rawQuery = target.RawQuery + "&" + rawQuery
-					} else {
-						rawQuery = target.RawQuery
-					}
-				}
-				req.URL.Path = joinURLPath(target.Path, req.URL.Path)
-				req.URL.RawQuery = rawQuery
-			} else {
-				resolved := *target
-				if resolved.RawQuery == "" {
-					resolved.RawQuery = req.URL.RawQuery
-				}
-				req.URL.Path = resolved.Path
-				req.URL.RawPath = resolved.RawPath
-				req.URL.RawQuery = resolved.RawQuery
-			}
-
-			req.Host = target.Host
-			req.Header.Del("X-Proxy-Target")
-		},
-		ModifyResponse: func(resp *http.Response) error {
-			body, readErr := io.ReadAll(resp.Body)
-			if readErr != nil {
-				entry.SetError(fmt.Sprintf("read response body: %v", readErr))
-				return readErr
-			}
-			_ = resp.Body.Close()
-			entry.SetResponse(resp, body)
-			resp.Body = io.NopCloser(bytes.NewReader(body))
-			return nil
-		},
-		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, proxyErr error) {
-			entry.SetError(proxyErr.Error())
-			entry.SetDurationSinceStart()
-			http.Error(rw, proxyErr.Error(), http.StatusBadGateway)
-		},
+	if verbosePath != "" {
+		pattern, err := regexp.Compile(verbosePath)
+		if err != nil {
+			log.Fatalf("invalid verbose path: %v", err)
+		}
+		store.VerbosePath = pattern
+		store.VerboseBodyLimit = verboseBodyLimit
 	}
-
-	entry.SetTarget(target.String())
-	proxy.ServeHTTP(w, r)
-	entry.SetDurationSinceStart()
-}
-
-type LogEntry struct {
-	ID                    int64             `json:"id"`
-	StartedAt             time.Time         `json:"startedAt"`
-	DurationMillis        int64             `json:"durationMillis"`
-	ClientIP              string            `json:"clientIp"`
-	Method                string            `json:"method"`
-	URL                   string            `json:"url"`
-	Target                string            `json:"target"`
-	Status                int               `json:"status"`
-	RequestHeaders        map[string]string `json:"requestHeaders"`
-	ResponseHeaders       map[string]string `json:"responseHeaders"`
-	RequestBody           string            `json:"requestBody"`
-	RequestBodyEncoding   string            `json:"requestBodyEncoding"`
-	RequestBodyTruncated  bool              `json:"requestBodyTruncated"`
-	ResponseBody          string            `json:"responseBody"`
-	ResponseBodyEncoding  string            `json:"responseBodyEncoding"`
-	ResponseBodyTruncated bool              `json:"responseBodyTruncated"`
-	Error                 string            `json:"error,omitempty"`
-	RequestContentType    string            `json:"requestContentType"`
-	ResponseContentType   string            `json:"responseContentType"`
-	RequestContentLength  int64             `json:"requestContentLength"`
-	ResponseContentLength int64             `json:"responseContentLength"`
-
-	mu sync.Mutex
-}
-
-type LogEntryView struct {
-	ID                    int64             `json:"id"`
-	StartedAt             time.Time         `json:"startedAt"`
-	DurationMillis        int64             `json:"durationMillis"`
-	ClientIP              string            `json:"clientIp"`
-	Method                string            `json:"method"`
-	URL                   string            `json:"url"`
-	Target                string            `json:"target"`
-	Status                int               `json:"status"`
-	RequestHeaders        map[string]string `json:"requestHeaders"`
-	ResponseHeaders       map[string]string `json:"responseHeaders"`
-	RequestBody           string            `json:"requestBody"`
-	RequestBodyEncoding   string            `json:"requestBodyEncoding"`
-	RequestBodyTruncated  bool              `json:"requestBodyTruncated"`
-	ResponseBody          string            `json:"responseBody"`
-	ResponseBodyEncoding  string            `json:"responseBodyEncoding"`
-	ResponseBodyTruncated bool              `json:"responseBodyTruncated"`
-	Error                 string            `json:"error,omitempty"`
-	RequestContentType    string            `json:"requestContentType"`
-	ResponseContentType   string            `json:"responseContentType"`
-	RequestContentLength  int64             `json:"requestContentLength"`
-	ResponseContentLength int64             `json:"responseContentLength"`
-}
-
-func (e *LogEntry) SetTarget(target string) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	e.Target = target
-}
-
-func (e *LogEntry) SetRequestBody(body []byte) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	e.RequestContentLength = int64(len(body))
-	e.RequestContentType = http.DetectContentType(body)
-	e.RequestBody, e.RequestBodyEncoding, e.RequestBodyTruncated = formatBody(body)
-}
-
-func (e *LogEntry) SetResponse(resp *http.Response, body []byte) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	e.Status = resp.StatusCode
-	e.ResponseContentLength = int64(len(body))
-	e.ResponseContentType = resp.Header.Get("Content-Type")
-	e.ResponseHeaders = flattenHeaders(resp.Header)
-
-	bodyToFormat := decodeResponseBody(resp.Header, body)
-
-	e.ResponseBody, e.ResponseBodyEncoding, e.ResponseBodyTruncated = formatBody(bodyToFormat)
-}
-
-func (e *LogEntry) SetError(err string) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	e.Error = err
-}
-
-func (e *LogEntry) SetDurationSinceStart() {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	e.DurationMillis = time.Since(e.StartedAt).Milliseconds()
-}
-
-func (e *LogEntry) Snapshot() LogEntryView {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	return LogEntryView{
-		ID:                    e.ID,
-		StartedAt:             e.StartedAt,
-		DurationMillis:        e.DurationMillis,
-		ClientIP:              e.ClientIP,
-		Method:                e.Method,
-		URL:                   e.URL,
-		Target:                e.Target,
-		Status:                e.Status,
-		RequestHeaders:        cloneMap(e.RequestHeaders),
-		ResponseHeaders:       cloneMap(e.ResponseHeaders),
-		RequestBody:           e.RequestBody,
-		RequestBodyEncoding:   e.RequestBodyEncoding,
-		RequestBodyTruncated:  e.RequestBodyTruncated,
-		ResponseBody:          e.ResponseBody,
-		ResponseBodyEncoding:  e.ResponseBodyEncoding,
-		ResponseBodyTruncated: e.ResponseBodyTruncated,
-		Error:                 e.Error,
-		RequestContentType:    e.RequestContentType,
-		ResponseContentType:   e.ResponseContentType,
-		RequestContentLength:  e.RequestContentLength,
-		ResponseContentLength: e.ResponseContentLength,
+	for _, exclude := range logExclude {
+		pattern, err := regexp.Compile(exclude)
+		if err != nil {
+			log.Fatalf("invalid log exclude pattern: %v", err)
+		}
+		store.ExcludePaths = append(store.ExcludePaths, pattern)
 	}
-}
-
-type LogStore struct {
-	mu      sync.Mutex
-	limit   int
-	nextID  int64
-	entries []*LogEntry
-	index   map[int64]*LogEntry
-}
-
-func NewLogStore(limit int) *LogStore {
-	if limit <= 0 {
-		limit = defaultLogLimit
+	resolver := handler.Resolver
+	if targetSecret != "" {
+		resolver.TargetSecret = []byte(targetSecret)
 	}
-	return &LogStore{
-		limit: limit,
-		index: make(map[int64]*LogEntry),
+	for _, value := range hostRoutes {
+		name, target, err := proxy.ParseHostRoute(value)
+		if err != nil {
+			log.Fatalf("invalid host route: %v", err)
+		}
+		if resolver.HostRoutes == nil {
+			resolver.HostRoutes = make(map[string]*url.URL)
+		}
+		resolver.HostRoutes[name] = target
 	}
-}
-
-func (s *LogStore) NewEntry(r *http.Request) *LogEntry {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.nextID++
-	entry := &LogEntry{
-		ID:             s.nextID,
-		StartedAt:      time.Now(),
-		ClientIP:       clientIP(r),
-		Method:         r.Method,
-		URL:            r.URL.String(),
-		RequestHeaders: flattenHeaders(r.Header),
-	}
-	s.entries = append(s.entries, entry)
-	s.index[entry.ID] = entry
 
-	if len(s.entries) > s.limit {
-		oldest := s.entries[0]
-		delete(s.index, oldest.ID)
-		s.entries = s.entries[1:]
+	// A nil UI serves the assets embedded in the proxy package.
+	var ui fs.FS
+	if uiDir != "" {
+		if info, err := os.Stat(uiDir); err != nil || !info.IsDir() {
+			log.Fatalf("invalid UI directory: %s", uiDir)
+		}
+		ui = os.DirFS(uiDir)
 	}
 
-	return entry
-}
-
-func (s *LogStore) List() []LogEntryView {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	result := make([]LogEntryView, 0, len(s.entries))
-	for i := len(s.entries) - 1; i >= 0; i-- {
-		result = append(result, s.entries[i].Snapshot())
+	var bodyRewrites []proxy.BodyRewrite
+	for _, value := range responseRewrites {
+		rewrite, err := proxy.ParseBodyRewrite(value)
+		if err != nil {
+			log.Fatalf("invalid response rewrite: %v", err)
+		}
+		bodyRewrites = append(bodyRewrites, rewrite)
+	}
+
+	if detectLoops {
+		handler.InstanceID = fmt.Sprintf("%016x", rand.Uint64())
+	}
+	handler.Retries = retries
+	handler.AllowedMethods = proxy.ParseMethodList(allowMethods)
+	handler.CaptureBodyMethods = proxy.ParseMethodList(captureBodyMethods)
+	handler.ResponseRewrites = bodyRewrites
+	handler.RewriteRedirects = rewriteRedirects
+	handler.RewriteCookies = rewriteCookies
+	handler.NormalizePath = normalizePath
+	handler.KeepHeaders = proxy.ParseHeaderList(keepHeaders)
+	handler.Coalesce = coalesce
+	handler.ThrottleBytesPerSecond = throttleBPS
+	handler.ThrottleLatency = throttleLatency
+	handler.RespectRetryAfter = respectRetryAfter
+	handler.CookieJar = cookieJar
+	handler.CaptureTLS = captureTLS
+	handler.Insecure = insecure
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "user-agent" {
+			handler.UserAgent = &userAgent
+		}
+	})
+	if sampleRate < 1 {
+		handler.Sample = func() bool { return rand.Float64() < sampleRate }
 	}
-	return result
-}
-
-func (s *LogStore) Get(id int64) (LogEntryView, bool) {
-	s.mu.Lock()
-	entry, ok := s.index[id]
-	s.mu.Unlock()
-	if !ok {
-		return LogEntryView{}, false
+	if mockFile != "" {
+		mocks, err := proxy.LoadMockRules(mockFile)
+		if err != nil {
+			log.Fatalf("invalid mocks file: %v", err)
+		}
+		handler.Mocks = mocks
 	}
-	return entry.Snapshot(), true
-}
-
-func handleListLogs(store *LogStore) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		entries := store.List()
-		respondJSON(w, entries)
+	for _, value := range requestPatches {
+		patch, err := proxy.ParseRequestPatch(value)
+		if err != nil {
+			log.Fatalf("invalid request patch: %v", err)
+		}
+		handler.RequestPatches = append(handler.RequestPatches, patch)
 	}
-}
-
-func handleGetLog(store *LogStore) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		idStr := strings.TrimPrefix(r.URL.Path, "/api/logs/")
-		id, err := strconv.ParseInt(idStr, 10, 64)
+	for _, value := range targetHeaders {
+		host, name, headerValue, err := proxy.ParseTargetHeader(value)
 		if err != nil {
-			http.Error(w, "invalid log id", http.StatusBadRequest)
-			return
+			log.Fatalf("invalid target header: %v", err)
 		}
-		entry, ok := store.Get(id)
-		if !ok {
-			http.NotFound(w, r)
-			return
+		if handler.TargetHeaders == nil {
+			handler.TargetHeaders = make(map[string]http.Header)
 		}
-		respondJSON(w, entry)
+		if handler.TargetHeaders[host] == nil {
+			handler.TargetHeaders[host] = make(http.Header)
+		}
+		handler.TargetHeaders[host].Add(name, headerValue)
 	}
-}
-
-func respondJSON(w http.ResponseWriter, value any) {
-	w.Header().Set("Content-Type", "application/json")
-	encoder := json.NewEncoder(w)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(value); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	for _, value := range delays {
+		delay, err := proxy.ParsePathDelay(value)
+		if err != nil {
+			log.Fatalf("invalid delay: %v", err)
+		}
+		handler.Delays = append(handler.Delays, delay)
 	}
-}
-
-func clientIP(r *http.Request) string {
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		parts := strings.Split(forwarded, ",")
-		return strings.TrimSpace(parts[0])
+	for _, value := range forceStatuses {
+		override, err := proxy.ParseStatusOverride(value)
+		if err != nil {
+			log.Fatalf("invalid forced status: %v", err)
+		}
+		handler.StatusOverrides = append(handler.StatusOverrides, override)
 	}
-	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
-		return realIP
+	for _, value := range schemas {
+		rule, err := proxy.ParseSchemaRule(value)
+		if err != nil {
+			log.Fatalf("invalid schema: %v", err)
+		}
+		handler.Schemas = append(handler.Schemas, rule)
 	}
-	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		return host
+	if cacheMode != "" {
+		cache, err := proxy.LoadResponseCache(cacheFile, cacheMode == "replay")
+		if err != nil {
+			log.Fatalf("invalid cache file: %v", err)
+		}
+		cache.RedactBodyKeys = store.RedactBodyKeys
+		handler.Cache = cache
 	}
-	return r.RemoteAddr
-}
-
-func flattenHeaders(headers http.Header) map[string]string {
-	flat := make(map[string]string, len(headers))
-	for key, values := range headers {
-		flat[key] = strings.Join(values, ", ")
+	if cassetteMode != "" {
+		cassette, err := proxy.LoadCassette(cassetteFile, cassetteMode == "replay")
+		if err != nil {
+			log.Fatalf("invalid cassette: %v", err)
+		}
+		cassette.RedactBodyKeys = store.RedactBodyKeys
+		handler.Cache = cassette
 	}
-	return flat
-}
-
-func cloneMap(source map[string]string) map[string]string {
-	if source == nil {
-		return nil
+	if httpCache {
+		handler.HTTPCache = proxy.NewHTTPCache()
 	}
-	cloned := make(map[string]string, len(source))
-	for key, value := range source {
-		cloned[key] = value
+	if maxConcurrency > 0 {
+		handler.Limiter = proxy.NewConcurrencyLimiter(maxConcurrency, queueTimeout)
 	}
-	return cloned
-}
-
-func formatBody(body []byte) (string, string, bool) {
-	truncated := false
-	if len(body) > maxBodyLogSize {
-		body = body[:maxBodyLogSize]
-		truncated = true
+	if breakPath != "" {
+		pattern, err := regexp.Compile(breakPath)
+		if err != nil {
+			log.Fatalf("invalid break path: %v", err)
+		}
+		handler.Breakpoints = &proxy.Breakpoints{Pattern: pattern, Timeout: breakTimeout}
+	}
+	if breakerThreshold > 0 {
+		handler.Breaker = &proxy.CircuitBreaker{Threshold: breakerThreshold, Cooldown: breakerCooldown}
+	}
+
+	config := proxy.RuntimeConfig{
+		ListenAddr:        listenAddr,
+		DefaultTarget:     defaultTarget,
+		LogLimit:          logLimit,
+		MaxTotalBodyBytes: maxTotalBodyBytes,
+		MaxRequestSize:    maxRequestSize,
+		SampleRate:        sampleRate,
+		Retries:           retries,
+		AllowedMethods:    handler.AllowedMethods,
+		LogFormat:         logFormat,
+		Features: proxy.ConfigFeatures{
+			MethodAllowlist:  len(handler.AllowedMethods) > 0,
+			LogFilter:        store.PathFilter != nil || len(store.ExcludePaths) > 0,
+			ResponseRewrite:  len(bodyRewrites) > 0,
+			RewriteRedirects: rewriteRedirects,
+			RewriteCookies:   rewriteCookies,
+			Coalesce:         coalesce,
+			Sampling:         handler.Sample != nil,
+			CircuitBreaker:   handler.Breaker != nil,
+			MaxConcurrency:   handler.Limiter != nil,
+			NormalizePath:    normalizePath,
+			Delays:           len(handler.Delays) > 0,
+			BodyDir:          store.BodyDir != "",
+			Breakpoints:      handler.Breakpoints != nil,
+			CORS:             len(corsOrigins) > 0,
+			HostRoutes:       len(resolver.HostRoutes) > 0,
+			OmitBinary:       len(store.OmitBodyTypes) > 0,
+			Mocks:            len(handler.Mocks) > 0,
+			Throttle:         throttleBPS > 0 || throttleLatency > 0,
+			CookieJar:        cookieJar,
+			Cache:            cacheMode != "",
+			Cassette:         cassetteMode != "",
+			HTTPCache:        handler.HTTPCache != nil,
+			Schemas:          len(handler.Schemas) > 0,
+			TargetSignatures: targetSecret != "",
+			RedactBodyKeys:   len(store.RedactBodyKeys) > 0,
+			SortJSONKeys:     store.SortJSONKeys,
+			CaptureTLS:       captureTLS,
+			Insecure:         insecure,
+			ClientCert:       clientCert != "",
+			ForceStatus:      len(handler.StatusOverrides) > 0,
+			RequestPatches:   len(handler.RequestPatches) > 0,
+			Webhook:          store.Webhook != nil,
+			TargetHeaders:    len(handler.TargetHeaders) > 0,
+			RawHeaderCase:    rawHeaderCase,
+			DetectLoops:      detectLoops,
+		},
+	}
+	if upstreamProxyURL != nil {
+		// Redacted masks any password embedded in the proxy URL.
+		config.UpstreamProxy = upstreamProxyURL.Redacted()
 	}
+	admin := proxy.NewHandler(handler, proxy.AdminOptions{
+		UI:          ui,
+		NoUI:        noUI,
+		CORSOrigins: corsOrigins,
+		CompactJSON: compactJSON,
+		Config:      config,
+	})
 
-	if utf8.Valid(body) {
-		return string(body), "utf-8", truncated
+	server := &http.Server{
+		Handler:           proxy.LoggingMiddleware(admin, logFormat, trustedNets),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       readTimeout,
+		IdleTimeout:       idleTimeout,
 	}
 
-	if truncated {
-		// If truncated, we might have split a multi-byte character.
-		// Try removing up to 3 bytes from the end to see if it becomes valid.
-		for i := 1; i <= 3 && len(body) > i; i++ {
-			sub := body[:len(body)-i]
-			if utf8.Valid(sub) {
-				return string(sub), "utf-8", truncated
-			}
-		}
+	listener, err := listen(listenAddr)
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+	if rawHeaderCase {
+		listener = proxy.RawHeaderListener{Listener: listener}
+		server.ConnContext = proxy.RawHeaderConnContext
 	}
 
-	encoded := base64.StdEncoding.EncodeToString(body)
-	return encoded, "base64", truncated
-}
+	// Shut down cleanly on SIGINT/SIGTERM so Unix socket files are removed.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
 
-func decodeResponseBody(headers http.Header, body []byte) []byte {
-	if len(body) == 0 {
-		return body
+	log.Printf("listening on %s", listenAddr)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("server error: %v", err)
 	}
-
-	if isGzipEncoded(headers) || isGzipData(body) {
-		if decoded, err := gunzip(body); err == nil {
-			return decoded
+	// Serve returns as soon as Shutdown starts; wait for in-flight requests
+	// before saving what they recorded.
+	<-shutdownDone
+	if handler.Cache != nil {
+		if err := handler.Cache.Flush(); err != nil {
+			log.Printf("cache: %v", err)
 		}
 	}
-
-	return body
 }
 
-func isGzipEncoded(headers http.Header) bool {
-	encoding := strings.ToLower(headers.Get("Content-Encoding"))
-	return strings.Contains(encoding, "gzip")
-}
+const shutdownTimeout = 5 * time.Second
 
-func isGzipData(body []byte) bool {
-	return len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b
-}
+// defaultIdleTimeout is how long idle keep-alive client connections are
+// kept open by default.
+const defaultIdleTimeout = 2 * time.Minute
 
-func gunzip(body []byte) ([]byte, error) {
-	reader, err := gzip.NewReader(bytes.NewReader(body))
-	if err != nil {
-		return nil, err
+// listen opens a listener for addr, which is either a TCP address or
+// unix:/path/to/socket.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// Remove a socket file left behind by an unclean exit.
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
 	}
-	defer reader.Close()
-	return io.ReadAll(reader)
+	return net.Listen("unix", path)
 }
 
-func joinURLPath(a, b string) string {
-	aslash := strings.HasSuffix(a, "/")
-	bslash := strings.HasPrefix(b, "/")
-	switch {
-	case aslash && bslash:
-		return a + b[1:]
-	case !aslash && !bslash:
-		return a + "/" + b
-	}
-	return a + b
+// stringList is a flag.Value that collects repeated flag values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start))
-	})
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
@@ -0,0 +1,7422 @@
+// Package proxy implements Proxymystuff's logging reverse proxy: the
+// ProxyHandler that forwards requests, the LogStore that records them, and
+// the web UI and JSON API that browse the log.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	DefaultLogLimit       = 1000
+	DefaultMaxBodyLogSize = 64 * 1024
+	// DefaultVerboseBodyLimit is the capture limit for -verbose-path.
+	DefaultVerboseBodyLimit = 10 << 20
+)
+
+//go:embed web/*
+var webAssets embed.FS
+
+// Options configures the LogStore, TargetResolver and ProxyHandler built
+// by New. Zero values keep the defaults.
+type Options struct {
+	// LogLimit is the number of entries kept. DefaultLogLimit is used
+	// when it is 0.
+	LogLimit int
+	// MaxBodyLogSize is the number of bytes of each body captured before
+	// truncating. DefaultMaxBodyLogSize is used when it is 0.
+	MaxBodyLogSize int
+	// MaxTotalBodyBytes caps the captured body bytes kept across all
+	// entries. 0 is unlimited.
+	MaxTotalBodyBytes int64
+	// MaxRequestSize rejects larger request bodies with a 413. 0 is
+	// unlimited.
+	MaxRequestSize int64
+	// RedactBodyKeys lists JSON keys whose values are stored as "***" in
+	// captured bodies. Keys match case-insensitively.
+	RedactBodyKeys []string
+	// DefaultTarget receives requests that choose no target.
+	// FallbackTargets are tried in order when it fails.
+	DefaultTarget   *url.URL
+	FallbackTargets []*url.URL
+	// ResolveFunc chooses targets before the built-in rules. See
+	// TargetResolver.ResolveFunc.
+	ResolveFunc func(req *http.Request) (*url.URL, error)
+	// Transport is used for upstream requests. When nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+// New returns a ProxyHandler configured by opts, with a new LogStore and
+// TargetResolver. Other ProxyHandler, LogStore and TargetResolver fields
+// can be set on the result before it serves requests.
+func New(opts Options) *ProxyHandler {
+	store := NewLogStore(WithLimit(opts.LogLimit), WithMaxBodyBytes(opts.MaxTotalBodyBytes))
+	store.MaxBodyLogSize = opts.MaxBodyLogSize
+	store.RedactBodyKeys = ParseRedactKeys(strings.Join(opts.RedactBodyKeys, ","))
+	return &ProxyHandler{
+		Store: store,
+		Resolver: &TargetResolver{
+			DefaultTarget:   opts.DefaultTarget,
+			FallbackTargets: opts.FallbackTargets,
+			ResolveFunc:     opts.ResolveFunc,
+		},
+		Transport:      opts.Transport,
+		MaxRequestSize: opts.MaxRequestSize,
+	}
+}
+
+// AdminOptions configures the web UI and JSON API served by NewHandler.
+type AdminOptions struct {
+	// UI holds the web UI assets. The embedded assets are used when it is
+	// nil.
+	UI fs.FS
+	// NoUI answers the UI and API paths with 404 instead of serving them.
+	NoUI bool
+	// CORSOrigins lists the origins allowed to call the API cross-origin.
+	CORSOrigins []string
+	// CompactJSON makes compact JSON the default for API responses.
+	CompactJSON bool
+	// Config is reported by /api/config.
+	Config RuntimeConfig
+}
+
+// NewHandler returns a handler serving the web UI, the JSON API and the
+// /healthz and /readyz checks alongside proxy, which receives every other
+// request. It applies the routing rules of routeMiddleware.
+func NewHandler(proxy *ProxyHandler, opts AdminOptions) http.Handler {
+	store := proxy.Store
+	webFS := opts.UI
+	if webFS == nil {
+		// The pattern is a compile-time constant, so Sub cannot fail.
+		webFS, _ = fs.Sub(webAssets, "web")
+	}
+
+	mux := http.NewServeMux()
+	// With NoUI the admin paths stay registered so they 404 instead of
+	// being proxied.
+	registerAdmin := func(pattern string, handler http.Handler) {
+		if opts.NoUI {
+			handler = http.NotFoundHandler()
+		}
+		mux.Handle(pattern, handler)
+	}
+	// Admin routes (UI and API) are compressed; proxied traffic is not.
+	handleAdmin := func(pattern string, handler http.Handler) {
+		registerAdmin(pattern, gzipMiddleware(handler))
+	}
+	// API routes additionally answer cross-origin requests from
+	// CORSOrigins and choose their JSON indentation.
+	handleAPI := func(pattern string, handler http.Handler) {
+		handleAdmin(pattern, corsMiddleware(jsonFormatMiddleware(handler, opts.CompactJSON), opts.CORSOrigins))
+	}
+	replayer := &Replayer{proxy: proxy}
+	handleAdmin("/ui/", http.StripPrefix("/ui/", http.FileServer(http.FS(webFS))))
+	registerAdmin("/ui", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ui/", http.StatusFound)
+	}))
+	handleAPI("/api/logs", handleListLogs(store))
+	handleAPI("/api/logs/", handleGetLog(store, replayer))
+	handleAPI("/api/logs/postman", handlePostmanExport(store))
+	handleAPI("/api/logs/export", handleExportLogs(store))
+	handleAPI("/api/logs/import", handleImportLogs(store))
+	handleAPI("/api/stats", handleStats(store))
+	handleAPI("/api/replay", handleBulkReplay(store, replayer))
+	handleAPI("/api/debug", handleDebug(store))
+	handleAPI("/api/errors", handleRecentErrors(store))
+	handleAPI("/api/breakpoints", handleListBreakpoints(proxy))
+	handleAPI("/api/breakpoints/", handleContinueBreakpoint(proxy))
+	handleAPI("/api/sessions", handleListSessions(store))
+	handleAPI("/api/sessions/", handleGetSession(store))
+	registerAdmin("/api/logs/ws", handleLogStream(store, opts.CORSOrigins))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.Handle("/readyz", &ReadinessChecker{proxy: proxy})
+	handleAPI("/api/config", handleConfig(opts.Config, store))
+	handleAPI("/api/pause", handlePause(proxy, true))
+	handleAPI("/api/resume", handlePause(proxy, false))
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Without the UI, the root is not found unless a target serves it.
+		if opts.NoUI && r.URL.Path == "/" {
+			if _, _, err := proxy.Resolver.ResolveAll(r); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	return routeMiddleware(mux, proxy)
+}
+
+// rawHeaderWindow bounds how much of each connection's recent input a
+// rawHeaderConn keeps. Header blocks larger than this fall back to
+// canonical names.
+const rawHeaderWindow = 64 << 10
+
+// RawHeaderListener wraps accepted connections in rawHeaderConns so that
+// handlers can recover the original casing of request header names, which
+// net/http canonicalizes.
+type RawHeaderListener struct {
+	net.Listener
+}
+
+func (l RawHeaderListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rawHeaderConn{Conn: conn}, nil
+}
+
+// rawHeaderConn keeps the bytes read from a connection that have not yet
+// been matched to a request. Recording stops at the end of a header block
+// and resumes once its names are taken, after the request's body. Names are
+// only taken from a header block at the start of the recording, so body
+// bytes that look like a request are never mistaken for one. When the end of
+// a body is not known, as with chunked bodies, recording stops for the rest
+// of the connection.
+type rawHeaderConn struct {
+	net.Conn
+
+	mu  sync.Mutex
+	buf []byte
+	// headerEnded is set once buf holds a complete header block.
+	headerEnded bool
+	// dropped counts the bytes read while headerEnded was set.
+	dropped int64
+	// skip counts the body bytes still to be read past.
+	skip int64
+	// lost is set once the start of the next request is no longer known.
+	lost bool
+}
+
+func (c *rawHeaderConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data := p[:n]
+	if c.skip > 0 {
+		skipped := min(int64(len(data)), c.skip)
+		data = data[skipped:]
+		c.skip -= skipped
+	}
+	if c.lost {
+		return n, err
+	}
+	if c.headerEnded {
+		c.dropped += int64(len(data))
+		return n, err
+	}
+	if len(data) > 0 {
+		c.buf = append(c.buf, data...)
+		if excess := len(c.buf) - rawHeaderWindow; excess > 0 {
+			c.buf = append(c.buf[:0], c.buf[excess:]...)
+		}
+		c.headerEnded = hasHeaderBlockEnd(c.buf)
+	}
+	return n, err
+}
+
+// hasHeaderBlockEnd reports whether data contains the blank line that ends
+// a header block.
+func hasHeaderBlockEnd(data []byte) bool {
+	return bytes.Contains(data, []byte("\r\n\r\n")) || bytes.Contains(data, []byte("\n\n"))
+}
+
+// takeHeaderNames returns the field names, as sent, of the header block
+// that starts the recording with requestLine, and discards the input up to
+// its end and the bodyLength bytes of body after it. A bodyLength of -1
+// means the body is chunked.
+func (c *rawHeaderConn) takeHeaderNames(requestLine string, bodyLength int64) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lost {
+		return nil
+	}
+	dropped := c.dropped
+	c.headerEnded, c.dropped = false, 0
+	// Servers ignore blank lines before a request line.
+	rest := bytes.TrimLeft(c.buf, "\r\n")
+	if !bytes.HasPrefix(rest, []byte(requestLine)) {
+		c.stopRecording()
+		return nil
+	}
+	var names []string
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			// The header block was cut off by the window.
+			c.stopRecording()
+			return nil
+		}
+		line := bytes.TrimSuffix(rest[:i], []byte("\r"))
+		rest = rest[i+1:]
+		if len(line) == 0 {
+			break
+		}
+		if names == nil {
+			// The request line itself.
+			names = []string{}
+			continue
+		}
+		if name, _, ok := bytes.Cut(line, []byte(":")); ok && line[0] != ' ' && line[0] != '\t' {
+			names = append(names, string(name))
+		}
+	}
+	switch {
+	case bodyLength < 0:
+		c.stopRecording()
+		return names
+	case int64(len(rest)) >= bodyLength && dropped == 0:
+		// The rest is the start of a pipelined request.
+		rest = rest[bodyLength:]
+	case bodyLength-int64(len(rest))-dropped < 0:
+		// Bytes dropped past the body belonged to the next request.
+		c.stopRecording()
+		return names
+	default:
+		c.skip = bodyLength - int64(len(rest)) - dropped
+		rest = nil
+	}
+	c.buf = append(c.buf[:0], rest...)
+	c.headerEnded = hasHeaderBlockEnd(c.buf)
+	return names
+}
+
+// stopRecording gives up on the connection once the start of the next
+// request is no longer known. The caller must hold c.mu.
+func (c *rawHeaderConn) stopRecording() {
+	c.lost = true
+	c.buf = nil
+}
+
+type rawHeaderConnKey struct{}
+
+type rawHeaderNamesKey struct{}
+
+// RawHeaderConnContext is an http.Server ConnContext that makes a
+// rawHeaderConn available to rawHeaderNames.
+func RawHeaderConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if raw, ok := conn.(*rawHeaderConn); ok {
+		return context.WithValue(ctx, rawHeaderConnKey{}, raw)
+	}
+	return ctx
+}
+
+// rawHeaderNames returns r's header names as the client sent them, or nil
+// if they are unavailable. HTTP/2 names are always lowercase on the wire.
+func rawHeaderNames(r *http.Request) []string {
+	if r.ProtoMajor >= 2 {
+		names := make([]string, 0, len(r.Header))
+		for name := range r.Header {
+			names = append(names, strings.ToLower(name))
+		}
+		return names
+	}
+	if names, ok := r.Context().Value(rawHeaderNamesKey{}).([]string); ok {
+		return names
+	}
+	conn, ok := r.Context().Value(rawHeaderConnKey{}).(*rawHeaderConn)
+	if !ok {
+		return nil
+	}
+	return conn.takeHeaderNames(r.Method+" "+r.RequestURI+" ", r.ContentLength)
+}
+
+// withRawHeaderNames takes r's header names from its rawHeaderConn and
+// keeps them in r's context. Every request must be taken, logged or not,
+// for the connection to resume recording for the next one.
+func withRawHeaderNames(r *http.Request) *http.Request {
+	if r.ProtoMajor >= 2 || r.Context().Value(rawHeaderConnKey{}) == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), rawHeaderNamesKey{}, rawHeaderNames(r)))
+}
+
+const (
+	readinessTimeout  = 2 * time.Second
+	readinessCacheTTL = 5 * time.Second
+)
+
+// ReadinessChecker reports whether the default target is reachable. Results
+// are cached briefly so frequent probes don't hammer the backend.
+type ReadinessChecker struct {
+	Target    *url.URL
+	Transport http.RoundTripper
+
+	// proxy, when set, supplies the target and transport at each check in
+	// place of Target and Transport, so later changes to it are seen.
+	proxy *ProxyHandler
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	// checked is the target the cached result is for.
+	checked *url.URL
+	lastErr error
+}
+
+func (c *ReadinessChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := c.check(r.Context()); err != nil {
+		http.Error(w, fmt.Sprintf("default target unreachable: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+func (c *ReadinessChecker) check(ctx context.Context) error {
+	target, transport := c.Target, c.Transport
+	if c.proxy != nil {
+		target, transport = c.proxy.Resolver.DefaultTarget, c.proxy.Transport
+	}
+	if target == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < readinessCacheTTL && c.checked == target {
+		return c.lastErr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target.String(), nil)
+	if err == nil {
+		client := &http.Client{
+			Transport: transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		var resp *http.Response
+		if resp, err = client.Do(req); err == nil {
+			_ = resp.Body.Close()
+		}
+	}
+
+	c.checkedAt = time.Now()
+	c.checked = target
+	c.lastErr = err
+	return err
+}
+
+type TargetResolver struct {
+	DefaultTarget *url.URL
+	// FallbackTargets are tried in order when DefaultTarget fails.
+	FallbackTargets []*url.URL
+	// HostRoutes maps the first label of the request's Host, or the whole
+	// host name, to a target.
+	HostRoutes map[string]*url.URL
+	// TargetSecret, when set, requires targets chosen by the client (by
+	// header, query or path) to be signed with a hex HMAC-SHA256 of the
+	// target value in X-Proxy-Target-Signature.
+	TargetSecret []byte
+	// ResolveFunc, when set, is consulted before the built-in header, query,
+	// path and host rules, for programs embedding the proxy. It returns the
+	// target for req, to which the request path is appended, or nil to fall
+	// through to the built-in rules.
+	ResolveFunc func(req *http.Request) (*url.URL, error)
+}
+
+var errTargetSignature = errors.New("missing or invalid X-Proxy-Target-Signature")
+
+// Resolve returns the first target for req.
+func (r *TargetResolver) Resolve(req *http.Request) (*url.URL, bool, error) {
+	targets, useRequestPath, err := r.ResolveAll(req)
+	if err != nil {
+		return nil, false, err
+	}
+	return targets[0], useRequestPath, nil
+}
+
+// Resolution methods name the rule that chose a request's targets.
+const (
+	ResolvedByFunc      = "func"
+	ResolvedByHeader    = "header"
+	ResolvedByQuery     = "query"
+	ResolvedByPath      = "path"
+	ResolvedByHostRoute = "host-route"
+	ResolvedByDefault   = "default"
+)
+
+// ResolveAll returns the targets for req in failover order. X-Proxy-Target
+// may list several comma-separated targets.
+func (r *TargetResolver) ResolveAll(req *http.Request) ([]*url.URL, bool, error) {
+	targets, useRequestPath, _, err := r.ResolveMethod(req)
+	return targets, useRequestPath, err
+}
+
+// ResolveMethod is ResolveAll that also returns the ResolvedBy method of
+// the rule that matched.
+func (r *TargetResolver) ResolveMethod(req *http.Request) ([]*url.URL, bool, string, error) {
+	if r.ResolveFunc != nil {
+		target, err := r.ResolveFunc(req)
+		if err != nil {
+			return nil, false, "", err
+		}
+		if target != nil {
+			return []*url.URL{target}, true, ResolvedByFunc, nil
+		}
+	}
+
+	if header := req.Header.Get("X-Proxy-Target"); header != "" {
+		if err := r.verifySignature(header, req); err != nil {
+			return nil, false, "", err
+		}
+		var targets []*url.URL
+		for _, value := range SplitTargetList(header) {
+			target, _, err := parseTarget(value, req, true)
+			if err != nil {
+				return nil, false, "", err
+			}
+			targets = append(targets, target)
+		}
+		return targets, true, ResolvedByHeader, nil
+	}
+
+	query := req.URL.Query()
+	if target := query.Get("target"); target != "" {
+		if err := r.verifySignature(target, req); err != nil {
+			return nil, false, "", err
+		}
+		query.Del("target")
+		req.URL.RawQuery = query.Encode()
+		targets, useRequestPath, err := singleTarget(parseTarget(target, req, true))
+		return targets, useRequestPath, ResolvedByQuery, err
+	}
+
+	if strings.HasPrefix(req.URL.Path, "/proxy/") {
+		trimmed := strings.TrimPrefix(req.URL.Path, "/proxy/")
+		decoded, err := url.PathUnescape(trimmed)
+		if err != nil {
+			return nil, false, "", fmt.Errorf("invalid proxy path: %w", err)
+		}
+		if err := r.verifySignature(decoded, req); err != nil {
+			return nil, false, "", err
+		}
+		targets, useRequestPath, err := singleTarget(parseTarget(decoded, req, false))
+		return targets, useRequestPath, ResolvedByPath, err
+	}
+
+	if target := r.hostRoute(req.Host); target != nil {
+		return []*url.URL{target}, true, ResolvedByHostRoute, nil
+	}
+
+	if r.DefaultTarget != nil {
+		return append([]*url.URL{r.DefaultTarget}, r.FallbackTargets...), true, ResolvedByDefault, nil
+	}
+
+	return nil, false, "", errors.New("no target specified")
+}
+
+// verifySignature checks the X-Proxy-Target-Signature of a client-chosen
+// target when a TargetSecret is configured.
+func (r *TargetResolver) verifySignature(target string, req *http.Request) error {
+	if len(r.TargetSecret) == 0 {
+		return nil
+	}
+	signature, err := hex.DecodeString(req.Header.Get("X-Proxy-Target-Signature"))
+	if err != nil || !hmac.Equal(signature, signTarget(r.TargetSecret, target)) {
+		return errTargetSignature
+	}
+	return nil
+}
+
+// signTarget returns the HMAC-SHA256 of target under secret.
+func signTarget(secret []byte, target string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(target))
+	return mac.Sum(nil)
+}
+
+// hostRoute returns the target routed for host, matching the full host name
+// before its first label.
+func (r *TargetResolver) hostRoute(host string) *url.URL {
+	if len(r.HostRoutes) == 0 {
+		return nil
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.ToLower(host)
+	if target, ok := r.HostRoutes[host]; ok {
+		return target
+	}
+	label, _, _ := strings.Cut(host, ".")
+	return r.HostRoutes[label]
+}
+
+// ParseHostRoute parses a "name=target" host route.
+func ParseHostRoute(value string) (string, *url.URL, error) {
+	name, target, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return "", nil, fmt.Errorf("expected name=target, got %q", value)
+	}
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return "", nil, fmt.Errorf("invalid target for %s: %q", name, target)
+	}
+	return strings.ToLower(name), parsed, nil
+}
+
+func singleTarget(target *url.URL, useRequestPath bool, err error) ([]*url.URL, bool, error) {
+	if err != nil {
+		return nil, false, err
+	}
+	return []*url.URL{target}, useRequestPath, nil
+}
+
+// SplitTargetList splits a comma-separated list of target URLs. A comma
+// only starts a new target when it is followed by a scheme, so commas
+// inside a single URL are preserved.
+func SplitTargetList(value string) []string {
+	var targets []string
+	for _, piece := range strings.Split(value, ",") {
+		if len(targets) > 0 && !strings.Contains(piece, "://") {
+			targets[len(targets)-1] += "," + piece
+			continue
+		}
+		targets = append(targets, piece)
+	}
+	for i := range targets {
+		targets[i] = strings.TrimSpace(targets[i])
+	}
+	return targets
+}
+
+func parseTarget(target string, req *http.Request, useRequestPath bool) (*url.URL, bool, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid target: %w", err)
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return nil, false, errors.New("target must include scheme and host")
+	}
+	return parsed, useRequestPath, nil
+}
+
+type ProxyHandler struct {
+	Store    *LogStore
+	Resolver *TargetResolver
+	// Transport is used for upstream requests. When nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+	// Retries is the number of additional attempts made for idempotent
+	// requests that fail with a connection-level error.
+	Retries int
+	// AllowedMethods restricts which methods are proxied. When empty, all
+	// methods are allowed.
+	AllowedMethods []string
+	// CaptureBodyMethods restricts which methods have their request bodies
+	// read and logged. Other requests stream their bodies through. When
+	// empty, bodies of all methods are captured.
+	CaptureBodyMethods []string
+	// ResponseRewrites are applied in order to text response bodies.
+	ResponseRewrites []BodyRewrite
+	// RewriteRedirects rewrites Location headers that point at the target
+	// so that clients keep going through the proxy.
+	RewriteRedirects bool
+	// RewriteCookies strips the Domain attribute from Set-Cookie headers and
+	// adjusts their Path so cookies stick when accessed through the proxy.
+	RewriteCookies bool
+	// NormalizePath collapses repeated slashes and resolves "." and ".."
+	// segments in the upstream request path.
+	NormalizePath bool
+	// KeepHeaders lists hop-by-hop headers that are forwarded anyway.
+	KeepHeaders []string
+	// Coalesce shares one upstream call between identical concurrent GETs.
+	Coalesce bool
+	// Sample decides per request whether bodies are captured. When nil,
+	// every request is captured in full.
+	Sample func() bool
+	// Breaker rejects requests to hosts that keep failing. When nil, no
+	// circuit breaking is done.
+	Breaker *CircuitBreaker
+	// Limiter caps how many requests are forwarded to targets at once.
+	// When nil, there is no cap.
+	Limiter *ConcurrencyLimiter
+	// Breakpoints, when set, holds matching requests before they are
+	// forwarded until they are continued through the API.
+	Breakpoints *Breakpoints
+	// Mocks are answered by the proxy itself instead of a target.
+	Mocks []MockRule
+	// MaxRequestSize rejects requests with larger bodies with 413. Zero
+	// means unlimited.
+	MaxRequestSize int64
+	// ThrottleBytesPerSecond limits how fast response bodies are sent to
+	// the client. Zero means unlimited.
+	ThrottleBytesPerSecond int64
+	// ThrottleLatency delays each response before its first byte.
+	ThrottleLatency time.Duration
+	// Delays hold requests to matching paths before they are forwarded.
+	// The first matching delay applies.
+	Delays []PathDelay
+	// RespectRetryAfter retries a 429 response once after waiting for its
+	// Retry-After delay, if that is at most maxRetryAfterWait.
+	RespectRetryAfter bool
+	// UserAgent, when set, replaces the User-Agent sent upstream. An empty
+	// value sends no User-Agent at all.
+	UserAgent *string
+	// CookieJar keeps the cookies set by targets in a jar per client IP and
+	// sends them on that client's later requests.
+	CookieJar bool
+	// Cache records responses to disk or replays them from it. When nil,
+	// every request goes to its target.
+	Cache *ResponseCache
+	// HTTPCache serves GET requests from memory while the cached response
+	// is fresh. When nil, responses are not cached.
+	HTTPCache *HTTPCache
+	// Schemas validate JSON response bodies. Violations are recorded on the
+	// entry; the response is passed on unchanged.
+	Schemas []SchemaRule
+	// CaptureTLS records the certificate chain presented by HTTPS targets.
+	CaptureTLS bool
+	// RequestPatches are JSON merge patches applied to the bodies of
+	// matching JSON requests before they are forwarded and logged.
+	RequestPatches []RequestPatch
+	// StatusOverrides replace the status of responses to matching paths.
+	// The first matching override applies.
+	StatusOverrides []StatusOverride
+	// TargetHeaders are set on requests forwarded to a target, keyed by
+	// the lowercase target host, with or without its port.
+	TargetHeaders map[string]http.Header
+	// InstanceID is added to the loopHeader of every forwarded request so
+	// that routeMiddleware can recognize requests it sent to itself. When
+	// empty, no header is added and loops are not detected.
+	InstanceID string
+	// Insecure marks HTTPS entries as sent without certificate
+	// verification. The Transport must be configured to skip it.
+	Insecure bool
+
+	coalescer  coalescer
+	cookieJars cookieJars
+	paused     atomic.Bool
+}
+
+// SetPaused stops or resumes forwarding requests to targets.
+func (h *ProxyHandler) SetPaused(paused bool) {
+	h.paused.Store(paused)
+}
+
+// Paused reports whether proxying is paused.
+func (h *ProxyHandler) Paused() bool {
+	return h.paused.Load()
+}
+
+func (h *ProxyHandler) isDefaultTarget(target *url.URL) bool {
+	if h.Resolver == nil {
+		return false
+	}
+	candidates := append([]*url.URL{}, h.Resolver.FallbackTargets...)
+	if h.Resolver.DefaultTarget != nil {
+		candidates = append(candidates, h.Resolver.DefaultTarget)
+	}
+	// Host-routed targets are reached at the proxy's root too.
+	for _, routed := range h.Resolver.HostRoutes {
+		candidates = append(candidates, routed)
+	}
+	for _, candidate := range candidates {
+		if candidate.String() == target.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyBaseURL returns the scheme and host the client used to reach the proxy.
+func proxyBaseURL(r *http.Request) *url.URL {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: r.Host}
+}
+
+// rewriteLocationHeaders points Location and Content-Location headers that
+// reference the target host back at the proxy. Redirects for the default
+// target keep their path; others use the /proxy/ form so no extra headers
+// are needed to follow them.
+func rewriteLocationHeaders(resp *http.Response, target, proxyBase *url.URL, defaultTarget bool) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := resp.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		location, err := url.Parse(value)
+		if err != nil {
+			continue
+		}
+		if resp.Request != nil {
+			location = resp.Request.URL.ResolveReference(location)
+		}
+		if !strings.EqualFold(location.Host, target.Host) {
+			continue
+		}
+
+		rewritten := *proxyBase
+		basePath := strings.TrimSuffix(target.Path, "/")
+		if defaultTarget && hasPathPrefix(location.Path, basePath) {
+			rewritten.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(location.Path, basePath), "/")
+			rewritten.RawQuery = location.RawQuery
+			rewritten.Fragment = location.Fragment
+		} else {
+			rewritten.Path = "/proxy/" + location.String()
+			rewritten.RawPath = "/proxy/" + url.PathEscape(location.String())
+		}
+		resp.Header.Set(name, rewritten.String())
+	}
+}
+
+// hasPathPrefix reports whether path is base or lies below it. Unlike
+// strings.HasPrefix, "/basement" is not below "/base".
+func hasPathPrefix(path, base string) bool {
+	return base == "" || path == base || strings.HasPrefix(path, base+"/")
+}
+
+// rewriteSetCookieHeaders drops the Domain attribute of each cookie so it
+// binds to the proxy host. For the default target the target's base path is
+// stripped from Path; other targets are reached via varying proxy paths, so
+// Path is widened to "/".
+func rewriteSetCookieHeaders(headers http.Header, target *url.URL, defaultTarget bool) {
+	cookies := headers.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+
+	basePath := strings.TrimSuffix(target.Path, "/")
+	rewritten := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		attrs := strings.Split(cookie, ";")
+		kept := attrs[:1]
+		for _, attr := range attrs[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(attr), "=")
+			switch strings.ToLower(name) {
+			case "domain":
+				continue
+			case "path":
+				if !defaultTarget {
+					value = "/"
+				} else if hasPathPrefix(value, basePath) {
+					value = "/" + strings.TrimPrefix(strings.TrimPrefix(value, basePath), "/")
+				}
+				attr = " " + name + "=" + value
+			}
+			kept = append(kept, attr)
+		}
+		rewritten = append(rewritten, strings.Join(kept, ";"))
+	}
+
+	headers.Del("Set-Cookie")
+	for _, cookie := range rewritten {
+		headers.Add("Set-Cookie", cookie)
+	}
+}
+
+// BodyRewrite replaces every occurrence of Search with Replace.
+type BodyRewrite struct {
+	Search  string
+	Replace string
+}
+
+// ParseBodyRewrite parses a "search=replace" pair.
+func ParseBodyRewrite(value string) (BodyRewrite, error) {
+	search, replace, ok := strings.Cut(value, "=")
+	if !ok || search == "" {
+		return BodyRewrite{}, fmt.Errorf("expected search=replace, got %q", value)
+	}
+	return BodyRewrite{Search: search, Replace: replace}, nil
+}
+
+// rewriteResponseBody applies the configured rewrites to uncompressed text
+// bodies and updates the response length to match.
+func (h *ProxyHandler) rewriteResponseBody(resp *http.Response, body []byte) []byte {
+	if len(h.ResponseRewrites) == 0 || !isTextContentType(resp.Header.Get("Content-Type")) {
+		return body
+	}
+	// Gzip bodies are rewritten decompressed and then recompressed. Other
+	// encodings are passed through unchanged.
+	gzipped := false
+	switch encoding := resp.Header.Get("Content-Encoding"); {
+	case strings.EqualFold(strings.TrimSpace(encoding), "gzip"):
+		decoded, err := gunzip(body)
+		if err != nil {
+			return body
+		}
+		gzipped = true
+		body = decoded
+	case encoding != "":
+		return body
+	}
+	for _, rewrite := range h.ResponseRewrites {
+		body = bytes.ReplaceAll(body, []byte(rewrite.Search), []byte(rewrite.Replace))
+	}
+	if gzipped {
+		return regzipResponseBody(resp, body)
+	}
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return body
+}
+
+// regzipResponseBody compresses a modified body for a gzip-encoded resp and
+// updates its Content-Length to match.
+func regzipResponseBody(resp *http.Response, body []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, _ = writer.Write(body)
+	_ = writer.Close()
+	resp.ContentLength = int64(buf.Len())
+	resp.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	return buf.Bytes()
+}
+
+func isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// MockRule is a canned response for requests matching Method and Path. The
+// body may use text/template syntax, e.g. {{.Path}}, {{.Query.name}} or
+// {{.Header.X-Foo}}, evaluated per request.
+type MockRule struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+
+	template *template.Template
+}
+
+// mockTemplateData is the data available to mock body templates.
+type mockTemplateData struct {
+	Method string
+	Path   string
+	Query  map[string]string
+	Header map[string]string
+	Body   string
+}
+
+// mockActionPattern matches template actions, and mockFieldPattern the
+// .Query.name and .Header.Name references within them, which text/template
+// cannot express directly when the key contains a hyphen.
+var (
+	mockActionPattern = regexp.MustCompile(`\{\{.*?\}\}`)
+	mockFieldPattern  = regexp.MustCompile(`\.(Query|Header)\.([A-Za-z0-9_-]+)`)
+)
+
+// LoadMockRules reads a JSON array of mock rules from path.
+func LoadMockRules(path string) ([]MockRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []MockRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("mock %d (%s): %w", i+1, rules[i].Path, err)
+		}
+	}
+	return rules, nil
+}
+
+// compile parses the rule's body template.
+func (m *MockRule) compile() error {
+	if !strings.Contains(m.Body, "{{") {
+		return nil
+	}
+	source := mockActionPattern.ReplaceAllStringFunc(m.Body, func(action string) string {
+		return mockFieldPattern.ReplaceAllStringFunc(action, func(field string) string {
+			parts := mockFieldPattern.FindStringSubmatch(field)
+			key := parts[2]
+			if parts[1] == "Header" {
+				key = http.CanonicalHeaderKey(key)
+			}
+			return fmt.Sprintf("(index .%s %q)", parts[1], key)
+		})
+	})
+	tmpl, err := template.New(m.Path).Parse(source)
+	if err != nil {
+		return err
+	}
+	m.template = tmpl
+	return nil
+}
+
+func (m *MockRule) matches(r *http.Request) bool {
+	return (m.Method == "" || strings.EqualFold(m.Method, r.Method)) && m.Path == r.URL.Path
+}
+
+// render returns the response body for r, or the literal body if the
+// template fails to evaluate.
+func (m *MockRule) render(r *http.Request, body []byte) []byte {
+	if m.template == nil {
+		return []byte(m.Body)
+	}
+	data := mockTemplateData{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  make(map[string]string),
+		Header: make(map[string]string),
+		Body:   string(body),
+	}
+	for key, values := range r.URL.Query() {
+		data.Query[key] = values[0]
+	}
+	for key, values := range r.Header {
+		data.Header[key] = values[0]
+	}
+	var buf bytes.Buffer
+	if err := m.template.Execute(&buf, data); err != nil {
+		return []byte(m.Body)
+	}
+	return buf.Bytes()
+}
+
+func (h *ProxyHandler) findMock(r *http.Request) *MockRule {
+	for i := range h.Mocks {
+		if h.Mocks[i].matches(r) {
+			return &h.Mocks[i]
+		}
+	}
+	return nil
+}
+
+// throttleResponse applies the configured latency and bandwidth limits to
+// resp before it is sent to the client.
+func (h *ProxyHandler) throttleResponse(ctx context.Context, resp *http.Response) {
+	if h.ThrottleLatency > 0 {
+		timer := time.NewTimer(h.ThrottleLatency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+	if h.ThrottleBytesPerSecond > 0 {
+		resp.Body = &throttledReader{ReadCloser: resp.Body, bytesPerSecond: h.ThrottleBytesPerSecond, ctx: ctx, start: time.Now()}
+	}
+}
+
+// throttledReader limits reads to bytesPerSecond. Each read returns at
+// most one small chunk and waits until the total read so far is due at
+// that rate, so timer overshoot does not accumulate.
+type throttledReader struct {
+	io.ReadCloser
+	bytesPerSecond int64
+	ctx            context.Context
+	start          time.Time
+	read           int64
+}
+
+// throttleChunksPerSecond sets how finely throttled output is paced.
+const throttleChunksPerSecond = 100
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if chunk := max(t.bytesPerSecond/throttleChunksPerSecond, 1); int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.read += int64(n)
+		due := t.start.Add(time.Duration(t.read) * time.Second / time.Duration(t.bytesPerSecond))
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			timer.Stop()
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// rejectOversized answers a request whose body exceeds MaxRequestSize.
+func (h *ProxyHandler) rejectOversized(w http.ResponseWriter, entry *LogEntry) {
+	entry.SetStatus(http.StatusRequestEntityTooLarge)
+	entry.SetError(fmt.Sprintf("request body exceeds %d bytes", h.MaxRequestSize))
+	entry.SetDurationSinceStart()
+	http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+}
+
+func isMaxBytesError(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// serveMock answers r from mock and records the exchange on entry.
+func (h *ProxyHandler) serveMock(w http.ResponseWriter, r *http.Request, mock *MockRule, entry *LogEntry) {
+	requestBody, err := io.ReadAll(r.Body)
+	if isMaxBytesError(err) {
+		h.rejectOversized(w, entry)
+		return
+	}
+	if err != nil {
+		entry.SetError(fmt.Sprintf("read request body: %v", err))
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	recordRequestBody(entry, r.Header.Get("Content-Type"), requestBody)
+
+	status := mock.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := mock.render(r, requestBody)
+	for key, value := range mock.Headers {
+		w.Header().Set(key, value)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+
+	entry.SetTarget("mock")
+	entry.SetMocked()
+	entry.SetResponse(&http.Response{StatusCode: status, Header: w.Header().Clone()}, body)
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// serveCached answers a request from the response cache and records the
+// exchange on entry.
+func (h *ProxyHandler) serveCached(w http.ResponseWriter, cached cachedResponse, captureBodies bool, entry *LogEntry) {
+	for key, values := range cached.Header {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(cached.Body)))
+
+	resp := &http.Response{StatusCode: cached.Status, Header: w.Header().Clone(), ContentLength: int64(len(cached.Body))}
+	entry.SetTarget("cache")
+	entry.SetCacheHit()
+	if captureBodies {
+		entry.SetResponse(resp, cached.Body)
+	} else {
+		entry.SetResponseMetadata(resp)
+	}
+	w.WriteHeader(cached.Status)
+	_, _ = w.Write(cached.Body)
+}
+
+// ResponseCache records responses to a file, or replays them from it. A
+// request matches a recording when its method, upstream URL, body and
+// Authorization and Cookie headers are all equal to those recorded.
+// Cassettes, loaded with LoadCassette, are written as YAML and do not
+// compare the Authorization and Cookie headers, so that no trace of them is
+// kept in a file that is meant to be checked in.
+type ResponseCache struct {
+	// Path is the file the cache is loaded from and saved to.
+	Path string
+	// Replay serves matching requests from the cache. Otherwise responses
+	// are recorded into it.
+	Replay bool
+	// Strict fails requests that match no recording when replaying,
+	// instead of proxying them.
+	Strict bool
+	// RedactBodyKeys are redacted from recorded JSON bodies, and
+	// Set-Cookie values are masked, when it is set.
+	RedactBodyKeys []string
+
+	// cassette stores the recordings as a YAML cassette.
+	cassette bool
+
+	mu           sync.Mutex
+	interactions []recordedInteraction
+	index        map[string]int
+	dirty        bool
+	saveTimer    *time.Timer
+	// saveMu serializes writes of the file.
+	saveMu sync.Mutex
+}
+
+// recordedInteraction is a request and the response recorded for it.
+// Credentials is a hash of the request's Authorization and Cookie headers,
+// which cassettes leave empty.
+type recordedInteraction struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	Credentials string         `json:"credentials,omitempty"`
+	RequestBody []byte         `json:"requestBody,omitempty"`
+	Response    cachedResponse `json:"response"`
+}
+
+func (in *recordedInteraction) key() string {
+	bodyHash := sha256.Sum256(in.RequestBody)
+	return fmt.Sprintf("%s %s %s %x", in.Method, in.URL, in.Credentials, bodyHash)
+}
+
+type cachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// cacheSaveDelay batches the writes of recordings made close together.
+const cacheSaveDelay = 250 * time.Millisecond
+
+// LoadResponseCache reads the cache at path. A missing file yields an empty
+// cache.
+func LoadResponseCache(path string, replay bool) (*ResponseCache, error) {
+	return loadResponseCache(&ResponseCache{Path: path, Replay: replay})
+}
+
+// LoadCassette reads the YAML cassette at path. A missing file yields an
+// empty cassette. Requests that match no interaction fail when replaying.
+func LoadCassette(path string, replay bool) (*ResponseCache, error) {
+	return loadResponseCache(&ResponseCache{Path: path, Replay: replay, Strict: true, cassette: true})
+}
+
+func loadResponseCache(cache *ResponseCache) (*ResponseCache, error) {
+	path := cache.Path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var interactions []recordedInteraction
+	if cache.cassette {
+		doc, err := parseYAML(data)
+		if err == nil {
+			interactions, err = decodeCassette(doc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if err := json.Unmarshal(data, &interactions); err != nil {
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+			return nil, fmt.Errorf("%s was written by an older version; record it again", path)
+		}
+		return nil, err
+	}
+	for _, in := range interactions {
+		cache.add(in)
+	}
+	return cache, nil
+}
+
+// request returns the interaction that r, sent to upstream with body,
+// would be recorded as.
+func (c *ResponseCache) request(r *http.Request, upstream string, body []byte) recordedInteraction {
+	in := recordedInteraction{
+		Method:      r.Method,
+		URL:         upstream,
+		RequestBody: redactJSONBody(body, r.Header.Get("Content-Type"), c.RedactBodyKeys),
+	}
+	if !c.cassette {
+		in.Credentials = credentialsHash(r.Header)
+	}
+	return in
+}
+
+// lookup returns the response recorded for in when replaying.
+func (c *ResponseCache) lookup(in recordedInteraction) (cachedResponse, bool) {
+	if !c.Replay {
+		return cachedResponse{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.index[in.key()]
+	if !ok {
+		return cachedResponse{}, false
+	}
+	return c.interactions[i].Response, true
+}
+
+// record stores resp as the response to in and schedules a write of the
+// file. Server errors are not recorded.
+func (c *ResponseCache) record(in recordedInteraction, resp cachedResponse) {
+	if resp.Status >= 500 {
+		return
+	}
+	// Bodies are stored decoded, so that they can be redacted and read. One
+	// in an encoding that cannot be undone is not recorded when keys must
+	// be redacted from it.
+	body, decoded := decodeRecordedBody(resp.Header, resp.Body)
+	if !decoded && len(c.RedactBodyKeys) > 0 {
+		return
+	}
+	resp.Body = body
+	resp.Body = redactJSONBody(resp.Body, resp.Header.Get("Content-Type"), c.RedactBodyKeys)
+	if len(c.RedactBodyKeys) > 0 {
+		maskSetCookies(resp.Header)
+	}
+	in.Response = resp
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(in)
+	c.dirty = true
+	if c.saveTimer == nil {
+		c.saveTimer = time.AfterFunc(cacheSaveDelay, func() {
+			if err := c.Flush(); err != nil {
+				log.Printf("cache: %v", err)
+			}
+		})
+	}
+}
+
+// add stores in, replacing an earlier recording of the same request. The
+// caller must hold c.mu unless c is not yet shared.
+func (c *ResponseCache) add(in recordedInteraction) {
+	if c.index == nil {
+		c.index = make(map[string]int)
+	}
+	key := in.key()
+	if i, ok := c.index[key]; ok {
+		c.interactions[i] = in
+		return
+	}
+	c.index[key] = len(c.interactions)
+	c.interactions = append(c.interactions, in)
+}
+
+// Flush writes recordings that have not been saved yet. The file is
+// replaced atomically so a crash never leaves it half written.
+func (c *ResponseCache) Flush() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	c.mu.Lock()
+	if c.saveTimer != nil {
+		c.saveTimer.Stop()
+		c.saveTimer = nil
+	}
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	var data []byte
+	var err error
+	if c.cassette {
+		data = encodeCassette(c.interactions)
+	} else {
+		data, err = json.Marshal(c.interactions)
+	}
+	c.dirty = err != nil
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := c.Path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err == nil {
+		err = os.Rename(tmp, c.Path)
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// decodeRecordedBody undoes the Content-Encoding of a recorded response body,
+// removing the Content-Encoding and Content-Length headers from header. It
+// reports false, leaving header alone, when an encoding cannot be decoded.
+func decodeRecordedBody(header http.Header, body []byte) ([]byte, bool) {
+	var declared int
+	for _, encoding := range contentEncodings(header) {
+		if encoding != "identity" {
+			declared++
+		}
+	}
+	if declared == 0 || len(body) == 0 {
+		return body, true
+	}
+	decoded, removed := decodeResponseBody(header, body)
+	if removed == "" || len(strings.Split(removed, ", ")) < declared {
+		return body, false
+	}
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	return decoded, true
+}
+
+// credentialsHash returns a hash of the Authorization and Cookie headers,
+// or "" when there are none.
+func credentialsHash(header http.Header) string {
+	authorization, cookie := header.Values("Authorization"), header.Values("Cookie")
+	if len(authorization) == 0 && len(cookie) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(authorization, "\n") + "\x00" + strings.Join(cookie, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// maskSetCookies replaces the value of each cookie set by header with
+// "***", keeping its name and attributes.
+func maskSetCookies(header http.Header) {
+	cookies := header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	header.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		pair, attributes, hasAttributes := strings.Cut(cookie, ";")
+		name, _, _ := strings.Cut(pair, "=")
+		masked := strings.TrimSpace(name) + "=***"
+		if hasAttributes {
+			masked += ";" + attributes
+		}
+		header.Add("Set-Cookie", masked)
+	}
+}
+
+// encodeCassette writes interactions as YAML. Strings are double-quoted,
+// and bodies that are not valid UTF-8 are written base64-encoded.
+func encodeCassette(interactions []recordedInteraction) []byte {
+	var b bytes.Buffer
+	b.WriteString("interactions:\n")
+	for _, in := range interactions {
+		b.WriteString("  - request:\n")
+		fmt.Fprintf(&b, "      method: %s\n", strconv.Quote(in.Method))
+		fmt.Fprintf(&b, "      url: %s\n", strconv.Quote(in.URL))
+		writeCassetteBody(&b, in.RequestBody)
+		b.WriteString("    response:\n")
+		fmt.Fprintf(&b, "      status: %d\n", in.Response.Status)
+		if len(in.Response.Header) > 0 {
+			b.WriteString("      headers:\n")
+			names := make([]string, 0, len(in.Response.Header))
+			for name := range in.Response.Header {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(&b, "        %s:\n", strconv.Quote(name))
+				for _, value := range in.Response.Header[name] {
+					fmt.Fprintf(&b, "          - %s\n", strconv.Quote(value))
+				}
+			}
+		}
+		writeCassetteBody(&b, in.Response.Body)
+	}
+	return b.Bytes()
+}
+
+func writeCassetteBody(b *bytes.Buffer, body []byte) {
+	if utf8.Valid(body) {
+		fmt.Fprintf(b, "      body: %s\n", strconv.Quote(string(body)))
+	} else {
+		fmt.Fprintf(b, "      bodyBase64: %s\n", base64.StdEncoding.EncodeToString(body))
+	}
+}
+
+// decodeCassette reads interactions from a document parsed by parseYAML.
+func decodeCassette(doc any) ([]recordedInteraction, error) {
+	root, _ := doc.(map[string]any)
+	items, ok := root["interactions"].([]any)
+	if !ok {
+		if value, _ := root["interactions"].(string); value != "" {
+			return nil, errors.New("interactions must be a list")
+		}
+		return nil, nil
+	}
+	interactions := make([]recordedInteraction, 0, len(items))
+	for i, item := range items {
+		fields, _ := item.(map[string]any)
+		request, _ := fields["request"].(map[string]any)
+		response, _ := fields["response"].(map[string]any)
+		if request == nil || response == nil {
+			return nil, fmt.Errorf("interaction %d: expected request and response", i+1)
+		}
+		in := recordedInteraction{}
+		in.Method, _ = request["method"].(string)
+		in.URL, _ = request["url"].(string)
+		if in.Method == "" || in.URL == "" {
+			return nil, fmt.Errorf("interaction %d: request needs a method and url", i+1)
+		}
+		statusText, _ := response["status"].(string)
+		status, err := strconv.Atoi(statusText)
+		if err != nil || status < 100 || status > 999 {
+			return nil, fmt.Errorf("interaction %d: invalid status %q", i+1, statusText)
+		}
+		in.Response.Status = status
+		if in.RequestBody, err = cassetteBody(request); err != nil {
+			return nil, fmt.Errorf("interaction %d: request: %w", i+1, err)
+		}
+		if in.Response.Body, err = cassetteBody(response); err != nil {
+			return nil, fmt.Errorf("interaction %d: response: %w", i+1, err)
+		}
+		headers, _ := response["headers"].(map[string]any)
+		in.Response.Header = make(http.Header, len(headers))
+		for name, values := range headers {
+			switch values := values.(type) {
+			case string:
+				in.Response.Header.Add(name, values)
+			case []any:
+				for _, value := range values {
+					value, _ := value.(string)
+					in.Response.Header.Add(name, value)
+				}
+			}
+		}
+		interactions = append(interactions, in)
+	}
+	return interactions, nil
+}
+
+func cassetteBody(fields map[string]any) ([]byte, error) {
+	if encoded, ok := fields["bodyBase64"].(string); ok {
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+	body, _ := fields["body"].(string)
+	return []byte(body), nil
+}
+
+type yamlLine struct {
+	indent int
+	text   string
+}
+
+// parseYAML parses the block-style subset of YAML that cassettes use:
+// nested mappings and sequences whose scalars are plain, single-quoted or
+// double-quoted. Scalars are returned as strings. Flow collections other
+// than [] and {}, anchors and multi-line scalars are not supported.
+func parseYAML(data []byte) (any, error) {
+	var lines []yamlLine
+	for _, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, " \t\r")
+		text := strings.TrimLeft(raw, " ")
+		if text == "" || text == "---" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("tab indentation in %q", raw)
+		}
+		lines = append(lines, yamlLine{indent: len(raw) - len(text), text: text})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	doc, next, err := parseYAMLBlock(lines, 0, lines[0].indent)
+	if err == nil && next < len(lines) {
+		err = fmt.Errorf("unexpected indentation at %q", lines[next].text)
+	}
+	return doc, err
+}
+
+// parseYAMLBlock parses the mapping or sequence starting at lines[i], whose
+// entries are indented by indent. It returns the index of the first line
+// after the block.
+func parseYAMLBlock(lines []yamlLine, i, indent int) (any, int, error) {
+	if isYAMLSequenceItem(lines[i].text) {
+		var items []any
+		for i < len(lines) && lines[i].indent == indent && isYAMLSequenceItem(lines[i].text) {
+			rest := strings.TrimLeft(lines[i].text[1:], " ")
+			var item any
+			var err error
+			switch {
+			case rest == "":
+				i++
+				item = ""
+				if i < len(lines) && lines[i].indent > indent {
+					item, i, err = parseYAMLBlock(lines, i, lines[i].indent)
+				}
+			case isYAMLMappingEntry(rest):
+				// "- key: value" starts a mapping indented to the key.
+				lines[i] = yamlLine{indent: indent + len(lines[i].text) - len(rest), text: rest}
+				item, i, err = parseYAMLBlock(lines, i, lines[i].indent)
+			default:
+				item, err = parseYAMLScalar(rest)
+				i++
+			}
+			if err != nil {
+				return nil, i, err
+			}
+			items = append(items, item)
+		}
+		return items, i, nil
+	}
+
+	fields := make(map[string]any)
+	for i < len(lines) && lines[i].indent == indent && !isYAMLSequenceItem(lines[i].text) {
+		key, rest, ok := splitYAMLKey(lines[i].text)
+		if !ok {
+			return nil, i, fmt.Errorf("expected key: value, got %q", lines[i].text)
+		}
+		i++
+		var value any = ""
+		var err error
+		switch {
+		case rest != "":
+			value, err = parseYAMLScalar(rest)
+		case i < len(lines) && (lines[i].indent > indent || lines[i].indent == indent && isYAMLSequenceItem(lines[i].text)):
+			value, i, err = parseYAMLBlock(lines, i, lines[i].indent)
+		}
+		if err != nil {
+			return nil, i, err
+		}
+		fields[key] = value
+	}
+	return fields, i, nil
+}
+
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func isYAMLMappingEntry(text string) bool {
+	_, _, ok := splitYAMLKey(text)
+	return ok
+}
+
+// splitYAMLKey splits "key: value" into its key and the rest of the line.
+// The key may be double-quoted.
+func splitYAMLKey(text string) (key, rest string, ok bool) {
+	if strings.HasPrefix(text, `"`) {
+		quoted, err := strconv.QuotedPrefix(text)
+		if err != nil {
+			return "", "", false
+		}
+		key, _ = strconv.Unquote(quoted)
+		text = text[len(quoted):]
+		if text != ":" && !strings.HasPrefix(text, ": ") {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(text[1:]), true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// parseYAMLScalar returns the string value of a scalar. Double-quoted
+// scalars use Go's escape syntax, which covers the escapes YAML shares
+// with it.
+func parseYAMLScalar(text string) (any, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		quoted, err := strconv.QuotedPrefix(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted string %s", text)
+		}
+		return strconv.Unquote(quoted)
+	case strings.HasPrefix(text, "'"):
+		var b strings.Builder
+		for i := 1; i < len(text); i++ {
+			if text[i] != '\'' {
+				b.WriteByte(text[i])
+			} else if i+1 < len(text) && text[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+			} else {
+				return b.String(), nil
+			}
+		}
+		return nil, fmt.Errorf("unterminated string %s", text)
+	case text == "[]":
+		return []any{}, nil
+	case text == "{}":
+		return map[string]any{}, nil
+	}
+	if i := strings.Index(text, " #"); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimSpace(text), nil
+}
+
+const (
+	// httpCacheMaxEntries bounds the number of responses an HTTPCache
+	// holds.
+	httpCacheMaxEntries = 1000
+	// httpCacheMaxBodySize is the largest response body an HTTPCache
+	// stores.
+	httpCacheMaxBodySize = 1 << 20
+)
+
+// HTTPCache is an in-memory cache of GET responses. Responses are kept for
+// the freshness lifetime given by their Cache-Control or Expires headers.
+type HTTPCache struct {
+	mu        sync.Mutex
+	responses map[string]httpCacheEntry
+}
+
+type httpCacheEntry struct {
+	response cachedResponse
+	stored   time.Time
+	expires  time.Time
+	// age is how old the response already was when it was stored.
+	age time.Duration
+	// vary holds the request header values named by the response's Vary
+	// header, which later requests must match.
+	vary map[string]string
+}
+
+func NewHTTPCache() *HTTPCache {
+	return &HTTPCache{responses: make(map[string]httpCacheEntry)}
+}
+
+// lookup returns a fresh response stored under key whose Vary headers
+// match header, with an Age header added. Requests that ask to bypass
+// caches with no-cache or no-store always miss.
+func (c *HTTPCache) lookup(key string, header http.Header, now time.Time) (cachedResponse, bool) {
+	directives := cacheControlDirectives(header)
+	if _, ok := directives["no-cache"]; ok || header.Get("Pragma") == "no-cache" {
+		return cachedResponse{}, false
+	}
+	if _, ok := directives["no-store"]; ok {
+		return cachedResponse{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.responses[key]
+	if !ok {
+		return cachedResponse{}, false
+	}
+	if !now.Before(cached.expires) {
+		delete(c.responses, key)
+		return cachedResponse{}, false
+	}
+	for name, value := range cached.vary {
+		if header.Get(name) != value {
+			return cachedResponse{}, false
+		}
+	}
+	response := cached.response
+	response.Header = response.Header.Clone()
+	response.Header.Set("Age", strconv.Itoa(int((cached.age+now.Sub(cached.stored))/time.Second)))
+	return response, true
+}
+
+// store caches resp under key for its freshness lifetime. When the cache is
+// full, expired responses are dropped first, then the one closest to
+// expiring.
+func (c *HTTPCache) store(key string, resp cachedResponse, requestHeader http.Header, now time.Time) {
+	lifetime, ok := httpCacheLifetime(resp.Header, now)
+	if !ok || len(resp.Body) > httpCacheMaxBodySize {
+		return
+	}
+	vary := make(map[string]string)
+	for _, field := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(field, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary[http.CanonicalHeaderKey(name)] = requestHeader.Get(name)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.responses[key]; !exists && len(c.responses) >= httpCacheMaxEntries {
+		c.evict(now)
+	}
+	c.responses[key] = httpCacheEntry{response: resp, stored: now, expires: now.Add(lifetime), age: responseAge(resp.Header), vary: vary}
+}
+
+// evict makes room for one response. The caller must hold c.mu.
+func (c *HTTPCache) evict(now time.Time) {
+	var soonest string
+	for key, cached := range c.responses {
+		if !now.Before(cached.expires) {
+			delete(c.responses, key)
+		} else if soonest == "" || cached.expires.Before(c.responses[soonest].expires) {
+			soonest = key
+		}
+	}
+	if len(c.responses) >= httpCacheMaxEntries {
+		delete(c.responses, soonest)
+	}
+}
+
+// httpCacheable reports whether resp, the response to a GET request with
+// requestHeader, may be stored by a shared cache.
+func httpCacheable(requestHeader http.Header, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if _, ok := cacheControlDirectives(requestHeader)["no-store"]; ok {
+		return false
+	}
+	directives := cacheControlDirectives(resp.Header)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return false
+		}
+	}
+	if resp.Header.Get("Vary") == "*" || resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	if _, public := directives["public"]; requestHeader.Get("Authorization") != "" && !public {
+		return false
+	}
+	_, ok := httpCacheLifetime(resp.Header, time.Now())
+	return ok
+}
+
+// httpCacheLifetime returns how long a response with header stays fresh:
+// s-maxage, then max-age, then Expires relative to Date, less the Age the
+// response arrived with. It reports false when the response is not fresh
+// at all.
+func httpCacheLifetime(header http.Header, now time.Time) (time.Duration, bool) {
+	directives := cacheControlDirectives(header)
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, false
+			}
+			lifetime := time.Duration(seconds)*time.Second - responseAge(header)
+			return lifetime, lifetime > 0
+		}
+	}
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		return 0, false
+	}
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		now = date
+	}
+	lifetime := expires.Sub(now) - responseAge(header)
+	return lifetime, lifetime > 0
+}
+
+// responseAge returns the Age a response was sent with, which is how long
+// upstream caches have already held it.
+func responseAge(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Age"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// cacheControlDirectives parses the Cache-Control header into lowercase
+// directive names and their unquoted values.
+func cacheControlDirectives(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, field := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(field, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entry := h.Store.NewEntry(r)
+	defer h.Store.Complete(entry)
+
+	if h.Paused() {
+		entry.SetStatus(http.StatusServiceUnavailable)
+		entry.SetError("proxy paused")
+		entry.SetDurationSinceStart()
+		http.Error(w, "proxying is paused; POST /api/resume to continue", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !h.methodAllowed(r.Method) {
+		entry.SetError(fmt.Sprintf("method %s not allowed", r.Method))
+		entry.SetDurationSinceStart()
+		w.Header().Set("Allow", strings.Join(h.AllowedMethods, ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var limited *limitedBody
+	if h.MaxRequestSize > 0 {
+		if r.ContentLength > h.MaxRequestSize {
+			h.rejectOversized(w, entry)
+			return
+		}
+		limited = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, h.MaxRequestSize)}
+		r.Body = limited
+	}
+
+	if mock := h.findMock(r); mock != nil {
+		h.serveMock(w, r, mock, entry)
+		entry.SetDurationSinceStart()
+		return
+	}
+
+	targets, useRequestPath, resolvedBy, err := h.Resolver.ResolveMethod(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errTargetSignature) {
+			status = http.StatusForbidden
+			entry.SetStatus(status)
+		}
+		entry.SetError(err.Error())
+		entry.SetDurationSinceStart()
+		http.Error(w, err.Error(), status)
+		return
+	}
+	entry.SetResolutionMethod(resolvedBy)
+
+	// Sample before reading any bodies so unsampled requests stream through.
+	captureBodies := h.Sample == nil || h.Sample()
+	captureRequestBody := captureBodies && h.capturesRequestBody(r.Method)
+	patch := h.requestPatchFor(r)
+	// A body sent with Expect: 100-continue is streamed so that the target
+	// decides whether the client sends it. Patches need it up front.
+	expectContinue := strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+	if expectContinue {
+		entry.SetExpectContinue()
+	}
+	// Held requests are read up front so that their bodies can be edited.
+	breakpoint := h.Breakpoints.matches(r)
+	readBody := (captureRequestBody && !expectContinue) || patch != nil || breakpoint
+	var requestBody []byte
+	if readBody {
+		requestBody, err = io.ReadAll(r.Body)
+		if isMaxBytesError(err) {
+			h.rejectOversized(w, entry)
+			return
+		}
+		if err != nil {
+			entry.SetError(fmt.Sprintf("read request body: %v", err))
+			entry.SetDurationSinceStart()
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		_ = r.Body.Close()
+		if patch != nil {
+			requestBody = patch.apply(requestBody)
+			r.ContentLength = int64(len(requestBody))
+		}
+		if breakpoint {
+			started := time.Now()
+			body, encoding, _ := formatBody(requestBody, len(requestBody))
+			edit, ok := h.Breakpoints.hold(r.Context(), PausedRequest{
+				EntryID:      entry.ID,
+				PausedAt:     started,
+				Method:       r.Method,
+				URL:          r.URL.String(),
+				Target:       targets[0].String(),
+				Headers:      flattenHeaders(r.Header),
+				Body:         body,
+				BodyEncoding: encoding,
+			})
+			entry.SetBreakpointDuration(time.Since(started))
+			if !ok {
+				entry.SetError("client went away at breakpoint")
+				entry.SetDurationSinceStart()
+				return
+			}
+			if edit.edited() {
+				requestBody = edit.apply(r, requestBody)
+				entry.SetEditedRequest(r.Method, r.Header)
+			}
+		}
+		if captureRequestBody {
+			recordRequestBody(entry, r.Header.Get("Content-Type"), requestBody)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(requestBody))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(requestBody)), nil
+		}
+	}
+	if !captureBodies {
+		entry.SkipBodyCapture(r.Header.Get("Content-Type"), r.ContentLength)
+	} else if !captureRequestBody {
+		entry.SkipRequestBodyCapture(r.Header.Get("Content-Type"), r.ContentLength)
+	} else if !readBody {
+		streamed := &capturingReader{ReadCloser: r.Body}
+		r.Body = streamed
+		// Runs before the deferred Complete.
+		defer func() {
+			recordRequestBody(entry, r.Header.Get("Content-Type"), streamed.Bytes())
+		}()
+	}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), newUpstreamTrace(entry, h.CaptureTLS)))
+	if h.NormalizePath {
+		// The client's path is cleaned before it is joined with the
+		// target's base path, so ".." segments cannot climb out of it.
+		inbound := *r.URL
+		normalizeURLPath(&inbound)
+		r.URL = &inbound
+	}
+
+	target := targets[0]
+	var cacheRequest *recordedInteraction
+	if h.Cache != nil && (readBody || r.ContentLength == 0) {
+		upstream := upstreamURL(r.URL, target, useRequestPath)
+		if h.NormalizePath {
+			normalizeURLPath(upstream)
+		}
+		request := h.Cache.request(r, upstream.String(), requestBody)
+		cacheRequest = &request
+		if cached, ok := h.Cache.lookup(request); ok {
+			h.serveCached(w, cached, captureBodies, entry)
+			entry.SetDurationSinceStart()
+			return
+		}
+	}
+	// Strict replays are deterministic: a request with no recording,
+	// including one whose body is streamed, never reaches the target.
+	if h.Cache != nil && h.Cache.Replay && h.Cache.Strict {
+		upstream := upstreamURL(r.URL, target, useRequestPath)
+		if h.NormalizePath {
+			normalizeURLPath(upstream)
+		}
+		message := fmt.Sprintf("no cassette interaction for %s %s", r.Method, upstream)
+		entry.SetStatus(http.StatusBadGateway)
+		entry.SetError(message)
+		entry.SetDurationSinceStart()
+		http.Error(w, message, http.StatusBadGateway)
+		return
+	}
+	var httpCacheKey string
+	// Responses to requests the cookie jar adds cookies to belong to that
+	// client, so they are neither served from nor stored in the cache.
+	if h.HTTPCache != nil && r.Method == http.MethodGet && !h.jarAddsCookies(r, upstreamURL(r.URL, target, useRequestPath), entry.ClientIP) {
+		httpCacheKey = coalesceKey(r.Method, target, useRequestPath, r.URL, nil, nil)
+		if cached, ok := h.HTTPCache.lookup(httpCacheKey, r.Header, time.Now()); ok {
+			h.serveCached(w, cached, captureBodies, entry)
+			entry.SetDurationSinceStart()
+			return
+		}
+	}
+	// The injected delay is served before a concurrency slot is taken,
+	// so delayed requests do not hold slots others are waiting for.
+	if delay := h.delayFor(r.URL.Path); delay > 0 {
+		started := time.Now()
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+		}
+		entry.SetInjectedDelay(time.Since(started))
+		if r.Context().Err() != nil {
+			entry.SetError("client went away during injected delay")
+			entry.SetDurationSinceStart()
+			return
+		}
+	}
+	if h.Limiter != nil {
+		wait, ok := h.Limiter.acquire(r.Context())
+		entry.SetQueueDuration(wait)
+		if !ok {
+			entry.SetStatus(http.StatusServiceUnavailable)
+			entry.SetError("too many concurrent requests")
+			entry.SetDurationSinceStart()
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer h.Limiter.release()
+	}
+
+	schema := h.schemaFor(r.URL.Path)
+	statusOverride := h.statusOverrideFor(r.URL.Path)
+	transport := h.transportFor(entry, r.Header)
+	if len(targets) > 1 {
+		inbound := *r.URL
+		transport = &failoverTransport{next: transport, targets: targets, inbound: &inbound, useRequestPath: useRequestPath, entry: entry, headersFor: h.targetHeadersFor, insecure: h.Insecure}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Transport: transport,
+		Director: func(req *http.Request) {
+			req.URL = upstreamURL(req.URL, target, useRequestPath)
+			if h.NormalizePath {
+				normalizeURLPath(req.URL)
+			}
+			req.Host = target.Host
+			req.Header.Del("X-Proxy-Target")
+			req.Header.Del("X-Proxy-Target-Signature")
+			if h.InstanceID != "" {
+				req.Header.Add(loopHeader, h.InstanceID)
+			}
+			removeHopByHopHeaders(req.Header, h.KeepHeaders)
+			if h.UserAgent != nil {
+				// An empty value stops net/http from adding its default.
+				req.Header.Set("User-Agent", *h.UserAgent)
+			}
+			if headers := h.targetHeadersFor(req.URL); headers != nil {
+				for name, values := range headers {
+					req.Header[name] = slices.Clone(values)
+				}
+				entry.SetInjectedHeaders(headers)
+			}
+			entry.SetUpstreamURL(req.URL.String())
+			if h.sendsViaProxy(req) {
+				entry.SetUpstreamViaProxy()
+			}
+			if h.Insecure && req.URL.Scheme == "https" {
+				entry.SetTLSVerifySkipped()
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			defer h.throttleResponse(r.Context(), resp)
+			target := servingTarget(targets, resp.Request)
+			if !r.ProtoAtLeast(1, 1) {
+				// Deferred because reading the body fills in resp.Trailer.
+				defer adaptResponseForHTTP10(resp, r.Close)
+			}
+			if h.CaptureTLS && resp.TLS != nil {
+				// Reused connections skip the handshake trace.
+				entry.SetUpstreamTLS(summarizeTLS(*resp.TLS, resp.TLS.PeerCertificates))
+			}
+			if h.RewriteRedirects {
+				rewriteLocationHeaders(resp, target, proxyBaseURL(r), h.isDefaultTarget(target))
+			}
+			if h.RewriteCookies {
+				rewriteSetCookieHeaders(resp.Header, target, h.isDefaultTarget(target))
+			}
+			recordCache := cacheRequest != nil && !h.Cache.Replay
+			// Recordings keep the target's own response, so when recording
+			// the override is applied once it has been recorded.
+			if statusOverride != nil && !recordCache {
+				entry.SetUpstreamStatus(resp.StatusCode)
+				statusOverride.apply(resp)
+			}
+			storeHTTPCache := httpCacheKey != "" && httpCacheable(r.Header, resp)
+			if !captureBodies && len(h.ResponseRewrites) == 0 && !recordCache && !storeHTTPCache && schema == nil {
+				entry.SetResponseMetadata(resp)
+				return nil
+			}
+
+			body, readErr := io.ReadAll(resp.Body)
+			if declared, ok := declaredContentLength(resp); ok && declared != int64(len(body)) {
+				entry.SetContentLengthMismatch(declared, len(body))
+			}
+			if readErr != nil {
+				entry.SetError(fmt.Sprintf("read response body: %v", readErr))
+				return readErr
+			}
+			_ = resp.Body.Close()
+			body = h.rewriteResponseBody(resp, body)
+			if recordCache {
+				cached := cachedResponse{Status: resp.StatusCode, Header: resp.Header.Clone(), Body: body}
+				h.Cache.record(*cacheRequest, cached)
+				if statusOverride != nil {
+					entry.SetUpstreamStatus(resp.StatusCode)
+					statusOverride.apply(resp)
+					if statusOverride.clearsBody() {
+						body = nil
+					}
+					storeHTTPCache = httpCacheKey != "" && httpCacheable(r.Header, resp)
+				}
+			}
+			if captureBodies {
+				entry.SetResponse(resp, body)
+			} else {
+				entry.SetResponseMetadata(resp)
+			}
+			if schema != nil {
+				if errs := validateResponseSchema(resp.StatusCode, resp.Header, body, schema); len(errs) > 0 {
+					entry.SetSchemaErrors(errs)
+				}
+			}
+			if storeHTTPCache {
+				cached := cachedResponse{Status: resp.StatusCode, Header: resp.Header.Clone(), Body: body}
+				h.HTTPCache.store(httpCacheKey, cached, r.Header, time.Now())
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			return nil
+		},
+		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, proxyErr error) {
+			entry.SetError(proxyErr.Error())
+			entry.SetDurationSinceStart()
+			status := http.StatusBadGateway
+			if errors.Is(proxyErr, errCircuitOpen) {
+				status = http.StatusServiceUnavailable
+			} else if isMaxBytesError(proxyErr) || limited != nil && limited.exceeded.Load() {
+				// A streamed body can run past the limit while the
+				// transport is sending it, which it may report as a
+				// failed write rather than the limit error itself.
+				status = http.StatusRequestEntityTooLarge
+				entry.SetStatus(status)
+			}
+			http.Error(rw, proxyErr.Error(), status)
+		},
+	}
+	if h.ThrottleBytesPerSecond > 0 {
+		// Flush every paced chunk instead of letting the response buffer
+		// gather them into bursts.
+		proxy.FlushInterval = -1
+	}
+
+	entry.SetTarget(target.String())
+	if !r.ProtoAtLeast(1, 1) {
+		w = http10ResponseWriter{w}
+	}
+	if h.Coalesce && r.Method == http.MethodGet && (readBody || r.ContentLength == 0) {
+		h.serveCoalesced(w, r, proxy, entry, coalesceKey(r.Method, target, useRequestPath, r.URL, r.Header, requestBody))
+	} else {
+		proxy.ServeHTTP(w, r)
+	}
+	entry.SetDurationSinceStart()
+}
+
+// declaredContentLength returns the Content-Length the target sent for a
+// response that should carry a body.
+func declaredContentLength(resp *http.Response) (int64, bool) {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return 0, false
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return 0, false
+	}
+	declared, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil || declared < 0 {
+		return 0, false
+	}
+	return declared, true
+}
+
+// ParseTargetHeader parses "host=Name: value".
+func ParseTargetHeader(value string) (host, name, headerValue string, err error) {
+	host, header, ok := strings.Cut(value, "=")
+	if ok {
+		name, headerValue, ok = strings.Cut(header, ":")
+	}
+	name = strings.TrimSpace(name)
+	if !ok || host == "" || name == "" {
+		return "", "", "", fmt.Errorf("expected host=Name: value, got %q", value)
+	}
+	return strings.ToLower(host), http.CanonicalHeaderKey(name), strings.TrimSpace(headerValue), nil
+}
+
+// targetHeadersFor returns the headers configured for target's host, or nil.
+func (h *ProxyHandler) targetHeadersFor(target *url.URL) http.Header {
+	if headers, ok := h.TargetHeaders[strings.ToLower(target.Host)]; ok {
+		return headers
+	}
+	return h.TargetHeaders[strings.ToLower(target.Hostname())]
+}
+
+// limitedBody records whether a request body read through
+// http.MaxBytesReader ran past its limit.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded atomic.Bool
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	if isMaxBytesError(err) {
+		l.exceeded.Store(true)
+	}
+	return n, err
+}
+
+// capturingReader keeps a copy of a request body as it is streamed to the
+// target.
+type capturingReader struct {
+	io.ReadCloser
+
+	// The transport may still be reading when the response is done.
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *capturingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.mu.Lock()
+	c.buf.Write(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+// Bytes returns a copy of the body read so far.
+func (c *capturingReader) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.buf.Bytes())
+}
+
+// RequestPatch is a JSON merge patch (RFC 7386) for the bodies of requests
+// to paths matching Pattern.
+type RequestPatch struct {
+	Pattern *regexp.Regexp
+	Patch   map[string]any
+}
+
+// ParseRequestPatch parses "pattern={json}". The pattern ends at the first
+// "={".
+func ParseRequestPatch(value string) (RequestPatch, error) {
+	i := strings.Index(value, "={")
+	if i <= 0 {
+		return RequestPatch{}, fmt.Errorf("expected pattern={json}, got %q", value)
+	}
+	pattern, err := regexp.Compile(value[:i])
+	if err != nil {
+		return RequestPatch{}, err
+	}
+	decoder := json.NewDecoder(strings.NewReader(value[i+1:]))
+	decoder.UseNumber()
+	var patch map[string]any
+	if err := decoder.Decode(&patch); err != nil {
+		return RequestPatch{}, fmt.Errorf("invalid patch in %q: %w", value, err)
+	}
+	return RequestPatch{Pattern: pattern, Patch: patch}, nil
+}
+
+// requestPatchFor returns the first patch matching a JSON request, or nil.
+func (h *ProxyHandler) requestPatchFor(r *http.Request) *RequestPatch {
+	if len(h.RequestPatches) == 0 || bodyLanguage(r.Header.Get("Content-Type"), "") != "json" {
+		return nil
+	}
+	for i := range h.RequestPatches {
+		if h.RequestPatches[i].Pattern.MatchString(r.URL.Path) {
+			return &h.RequestPatches[i]
+		}
+	}
+	return nil
+}
+
+// apply merges the patch into a JSON object body. Bodies that are not JSON
+// objects are returned unchanged.
+func (p *RequestPatch) apply(body []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document map[string]any
+	if err := decoder.Decode(&document); err != nil || document == nil {
+		return body
+	}
+	patched, err := marshalJSONUnescaped(mergePatch(document, p.Patch))
+	if err != nil {
+		return body
+	}
+	return patched
+}
+
+// mergePatch applies patch to target as described in RFC 7386: null removes
+// a member, objects are merged recursively, and anything else replaces.
+func mergePatch(target any, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = make(map[string]any)
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// StatusOverride forces the status of responses to paths matching Pattern,
+// optionally dropping their bodies.
+type StatusOverride struct {
+	Pattern   *regexp.Regexp
+	Status    int
+	ClearBody bool
+}
+
+// ParseStatusOverride parses "pattern=status" or "pattern=status:empty".
+// The pattern may itself contain "=", so the value is split at the last one.
+func ParseStatusOverride(value string) (StatusOverride, error) {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return StatusOverride{}, fmt.Errorf("expected pattern=status, got %q", value)
+	}
+	statusText, clearBody := strings.CutSuffix(value[i+1:], ":empty")
+	status, err := strconv.Atoi(statusText)
+	if err != nil || status < 200 || status > 999 {
+		return StatusOverride{}, fmt.Errorf("invalid status in %q", value)
+	}
+	pattern, err := regexp.Compile(value[:i])
+	if err != nil {
+		return StatusOverride{}, err
+	}
+	return StatusOverride{Pattern: pattern, Status: status, ClearBody: clearBody}, nil
+}
+
+// PathDelay holds requests to paths matching Pattern for Delay before they
+// are forwarded.
+type PathDelay struct {
+	Pattern *regexp.Regexp
+	Delay   time.Duration
+}
+
+// ParsePathDelay parses "pattern=duration", such as "^/api/slow=2s". The
+// pattern may itself contain "=", so the value is split at the last one.
+func ParsePathDelay(value string) (PathDelay, error) {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return PathDelay{}, fmt.Errorf("expected pattern=duration, got %q", value)
+	}
+	delay, err := time.ParseDuration(value[i+1:])
+	if err != nil || delay < 0 {
+		return PathDelay{}, fmt.Errorf("invalid duration in %q", value)
+	}
+	pattern, err := regexp.Compile(value[:i])
+	if err != nil {
+		return PathDelay{}, err
+	}
+	return PathDelay{Pattern: pattern, Delay: delay}, nil
+}
+
+func (h *ProxyHandler) delayFor(path string) time.Duration {
+	for _, d := range h.Delays {
+		if d.Pattern.MatchString(path) {
+			return d.Delay
+		}
+	}
+	return 0
+}
+
+func (h *ProxyHandler) statusOverrideFor(path string) *StatusOverride {
+	for i := range h.StatusOverrides {
+		if h.StatusOverrides[i].Pattern.MatchString(path) {
+			return &h.StatusOverrides[i]
+		}
+	}
+	return nil
+}
+
+// clearsBody reports whether the override drops the body: when ClearBody
+// is set, or when the forced status cannot carry one.
+func (o *StatusOverride) clearsBody() bool {
+	return o.ClearBody || !statusAllowsBody(o.Status)
+}
+
+// statusAllowsBody reports whether a response with status may carry a
+// body and a Content-Length.
+func statusAllowsBody(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// apply rewrites resp's status, and drops its body if clearsBody says so.
+func (o *StatusOverride) apply(resp *http.Response) {
+	resp.StatusCode = o.Status
+	resp.Status = fmt.Sprintf("%d %s", o.Status, http.StatusText(o.Status))
+	if o.clearsBody() {
+		_ = resp.Body.Close()
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+		resp.Header.Del("Content-Encoding")
+		if statusAllowsBody(o.Status) {
+			resp.Header.Set("Content-Length", "0")
+		} else {
+			resp.Header.Del("Content-Length")
+		}
+	}
+}
+
+// adaptResponseForHTTP10 strips what an HTTP/1.0 client cannot handle from
+// an upstream HTTP/1.1 response. Trailers cannot be sent without chunked
+// encoding, so they are dropped rather than announced. When the client did
+// not ask for keep-alive, the response says the connection will close.
+func adaptResponseForHTTP10(resp *http.Response, closeAfter bool) {
+	resp.Trailer = nil
+	if closeAfter {
+		resp.Header.Set("Connection", "close")
+	}
+}
+
+// http10ResponseWriter suppresses informational (1xx) responses, which
+// HTTP/1.0 clients do not understand.
+type http10ResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w http10ResponseWriter) WriteHeader(status int) {
+	if status >= 100 && status < 200 {
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w http10ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// sendsViaProxy reports whether the transport routes req through an
+// upstream proxy, set by -upstream-proxy or the environment.
+func (h *ProxyHandler) sendsViaProxy(req *http.Request) bool {
+	transport, ok := h.Transport.(*http.Transport)
+	if h.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if !ok || transport.Proxy == nil {
+		return false
+	}
+	proxyURL, err := transport.Proxy(req)
+	return err == nil && proxyURL != nil
+}
+
+// upstreamURL returns the URL that a request for inbound is sent to on target.
+func upstreamURL(inbound, target *url.URL, useRequestPath bool) *url.URL {
+	u := *inbound
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+
+	if useRequestPath {
+		rawQuery := u.RawQuery
+		if target.RawQuery != "" {
+			if rawQuery != "" {
+				rawQuery = target.RawQuery + "&" + rawQuery
+			} else {
+				rawQuery = target.RawQuery
+			}
+		}
+		// The escaped paths are joined too, so that encoded slashes stay
+		// encoded instead of becoming segments.
+		u.Path = joinURLPath(target.Path, inbound.Path)
+		u.RawPath = joinURLPath(target.EscapedPath(), inbound.EscapedPath())
+		u.RawQuery = rawQuery
+	} else {
+		resolved := *target
+		if resolved.RawQuery == "" {
+			resolved.RawQuery = u.RawQuery
+		}
+		u.Path = resolved.Path
+		u.RawPath = resolved.RawPath
+		u.RawQuery = resolved.RawQuery
+	}
+	return &u
+}
+
+// servingTarget returns the target that req was sent to.
+func servingTarget(targets []*url.URL, req *http.Request) *url.URL {
+	if req != nil && len(targets) > 1 {
+		for _, target := range targets {
+			if target.Scheme == req.URL.Scheme && strings.EqualFold(target.Host, req.URL.Host) {
+				return target
+			}
+		}
+	}
+	return targets[0]
+}
+
+// recordRequestBody stores body on entry, summarizing multipart bodies and
+// decoding form bodies.
+func recordRequestBody(entry *LogEntry, contentType string, body []byte) {
+	if parts, err := parseMultipartParts(contentType, body); err == nil {
+		entry.SetRequestParts(contentType, body, parts)
+	} else {
+		entry.SetRequestBody(body)
+	}
+	if form, ok := parseFormBody(contentType, body); ok {
+		entry.SetRequestForm(form)
+	}
+	if operation, ok := parseGraphQLOperation(contentType, body); ok {
+		entry.SetGraphQLOperation(operation)
+	}
+}
+
+// coalesceKey identifies requests that would produce the same upstream call.
+// The Authorization and Cookie values in header are part of the key, so
+// requests made with different credentials never share a response.
+func coalesceKey(method string, target *url.URL, useRequestPath bool, requestURL *url.URL, header http.Header, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return fmt.Sprintf("%s %s %t %s %x %s", method, target, useRequestPath, requestURL.RequestURI(), bodyHash, credentialsHash(header))
+}
+
+// serveCoalesced shares a single upstream call between identical concurrent
+// requests. The first request (the leader) is proxied and logged; the
+// others wait for its response and are counted on the leader's entry
+// instead of being logged themselves.
+func (h *ProxyHandler) serveCoalesced(w http.ResponseWriter, r *http.Request, proxy http.Handler, entry *LogEntry, key string) {
+	call, leader := h.coalescer.join(key, entry)
+	if !leader {
+		h.Store.Discard(entry)
+		select {
+		case <-call.done:
+			call.response.writeTo(w)
+		case <-r.Context().Done():
+		}
+		return
+	}
+
+	// The upstream call outlives the leader's client so that followers
+	// still get the response if it goes away.
+	response := newBufferedResponse()
+	proxy.ServeHTTP(response, r.WithContext(context.WithoutCancel(r.Context())))
+	h.coalescer.finish(key, call, response)
+	response.writeTo(w)
+}
+
+type coalescedCall struct {
+	done     chan struct{}
+	entry    *LogEntry
+	response *bufferedResponse
+}
+
+// coalescer tracks in-flight upstream calls by key. The zero value is
+// ready to use.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// join returns the in-flight call for key, or registers a new one led by
+// entry. The boolean reports whether the caller is the leader.
+func (c *coalescer) join(key string, entry *LogEntry) (*coalescedCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call, ok := c.calls[key]; ok {
+		call.entry.AddCoalesced()
+		return call, false
+	}
+	if c.calls == nil {
+		c.calls = make(map[string]*coalescedCall)
+	}
+	call := &coalescedCall{done: make(chan struct{}), entry: entry}
+	c.calls[key] = call
+	return call, true
+}
+
+func (c *coalescer) finish(key string, call *coalescedCall, response *bufferedResponse) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	call.response = response
+	close(call.done)
+}
+
+// bufferedResponse is an http.ResponseWriter that records a complete
+// response so it can be replayed to several clients.
+type bufferedResponse struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	status := b.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(b.body.Bytes())
+}
+
+// newUpstreamTrace records details about the upstream connection on entry,
+// including how long DNS, connecting and the TLS handshake took when a new
+// connection is made.
+func newUpstreamTrace(entry *LogEntry, captureTLS bool) *httptrace.ClientTrace {
+	var mu sync.Mutex
+	var dnsStart, connectStart, tlsStart time.Time
+	started := func(start *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		// Dialing several addresses calls ConnectStart more than once;
+		// time from the first.
+		if start.IsZero() {
+			*start = time.Now()
+		}
+	}
+	since := func(start *time.Time) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Since(*start)
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { started(&dnsStart) },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			entry.SetDNSDuration(since(&dnsStart))
+		},
+		ConnectStart: func(string, string) { started(&connectStart) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				entry.SetConnectDuration(since(&connectStart))
+			}
+		},
+		TLSHandshakeStart: func() { started(&tlsStart) },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				entry.SetTLSHandshakeDuration(since(&tlsStart))
+			}
+			if captureTLS {
+				// A chain that failed verification is only available
+				// from the error.
+				var verifyErr *tls.CertificateVerificationError
+				if errors.As(err, &verifyErr) {
+					summary := summarizeTLS(state, verifyErr.UnverifiedCertificates)
+					summary.Error = verifyErr.Err.Error()
+					entry.SetUpstreamTLS(summary)
+				} else if err == nil {
+					entry.SetUpstreamTLS(summarizeTLS(state, state.PeerCertificates))
+				}
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Conn != nil {
+				entry.SetUpstreamAddr(info.Conn.RemoteAddr().String())
+			}
+		},
+		Got100Continue: entry.SetContinued,
+	}
+}
+
+func (h *ProxyHandler) methodAllowed(method string) bool {
+	if len(h.AllowedMethods) == 0 {
+		return true
+	}
+	for _, allowed := range h.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseHeaderList parses a comma-separated list of header names.
+func ParseHeaderList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// capturesRequestBody reports whether request bodies sent with method are
+// captured.
+func (h *ProxyHandler) capturesRequestBody(method string) bool {
+	if len(h.CaptureBodyMethods) == 0 {
+		return true
+	}
+	for _, captured := range h.CaptureBodyMethods {
+		if strings.EqualFold(captured, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMethodList parses a comma-separated list of HTTP methods.
+func ParseMethodList(value string) []string {
+	var methods []string
+	for _, method := range strings.Split(value, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			methods = append(methods, strings.ToUpper(method))
+		}
+	}
+	return methods
+}
+
+func (h *ProxyHandler) transportFor(entry *LogEntry, inbound http.Header) http.RoundTripper {
+	transport := h.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if h.Breaker != nil {
+		transport = &breakerTransport{next: transport, breaker: h.Breaker, entry: entry}
+	}
+	if h.CookieJar {
+		transport = &cookieJarTransport{next: transport, jar: h.cookieJars.forClient(entry.ClientIP), entry: entry}
+	}
+	if len(h.KeepHeaders) > 0 {
+		transport = &keepHeadersTransport{next: transport, keep: h.KeepHeaders, inbound: inbound}
+	}
+	if h.Retries > 0 {
+		transport = &retryTransport{next: transport, retries: h.Retries, entry: entry}
+	}
+	if h.RespectRetryAfter {
+		transport = &retryAfterTransport{next: transport, entry: entry}
+	}
+	return transport
+}
+
+// hopByHopHeaders are the connection-specific headers defined by RFC 7230
+// section 6.1, plus the widely used non-standard ones.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders strips hop-by-hop headers, including any named in the
+// Connection header, except those listed in keep. Connection and Upgrade
+// are left on upgrade requests so ReverseProxy can negotiate the switch.
+func removeHopByHopHeaders(header http.Header, keep []string) {
+	kept := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		kept[http.CanonicalHeaderKey(name)] = true
+	}
+	if headerContainsToken(header, "Connection", "upgrade") {
+		kept["Connection"] = true
+		kept["Upgrade"] = true
+	}
+
+	var names []string
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				names = append(names, http.CanonicalHeaderKey(token))
+			}
+		}
+	}
+	names = append(names, hopByHopHeaders...)
+
+	for _, name := range names {
+		if !kept[name] {
+			header.Del(name)
+		}
+	}
+}
+
+// keepHeadersTransport restores hop-by-hop headers listed in -keep-headers.
+// ReverseProxy strips hop-by-hop headers after the Director runs, so they
+// have to be put back just before the request is sent.
+type keepHeadersTransport struct {
+	next    http.RoundTripper
+	keep    []string
+	inbound http.Header
+}
+
+func (t *keepHeadersTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for _, name := range t.keep {
+		if values := t.inbound.Values(name); len(values) > 0 && req.Header.Get(name) == "" {
+			req.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// retryTransport retries idempotent requests that fail before a response is
+// received. HTTP error statuses are returned as-is and never retried.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	entry   *LogEntry
+}
+
+const retryBaseBackoff = 100 * time.Millisecond
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if !isIdempotentMethod(req.Method) {
+		return resp, err
+	}
+
+	for attempt := 1; err != nil && attempt <= t.retries; attempt++ {
+		if req.Context().Err() != nil {
+			break
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				break
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				break
+			}
+			req.Body = body
+		}
+
+		select {
+		case <-time.After(retryBaseBackoff << (attempt - 1)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		t.entry.SetRetries(attempt)
+		resp, err = t.next.RoundTrip(req)
+	}
+	return resp, err
+}
+
+var errCircuitOpen = errors.New("circuit breaker open for target host")
+
+// ConcurrencyLimiter is a semaphore bounding the number of requests in
+// flight to targets. Requests beyond the limit wait up to QueueTimeout for
+// a free slot.
+type ConcurrencyLimiter struct {
+	QueueTimeout time.Duration
+
+	slots chan struct{}
+}
+
+func NewConcurrencyLimiter(limit int, queueTimeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{QueueTimeout: queueTimeout, slots: make(chan struct{}, limit)}
+}
+
+// acquire takes a slot, waiting up to QueueTimeout, and reports how long it
+// waited. Every successful acquire must be paired with a release.
+func (l *ConcurrencyLimiter) acquire(ctx context.Context) (time.Duration, bool) {
+	select {
+	case l.slots <- struct{}{}:
+		return 0, true
+	default:
+	}
+	if l.QueueTimeout <= 0 {
+		return 0, false
+	}
+	start := time.Now()
+	timer := time.NewTimer(l.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return time.Since(start), true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return time.Since(start), false
+}
+
+func (l *ConcurrencyLimiter) release() {
+	<-l.slots
+}
+
+// Breakpoints holds requests whose path matches Pattern before they are
+// forwarded, so that an operator can inspect and edit them. A held request
+// is released by Continue, or unchanged once Timeout passes.
+type Breakpoints struct {
+	Pattern *regexp.Regexp
+	// Timeout bounds how long a request is held. Zero holds it until it is
+	// continued or the client goes away.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	nextID int64
+	paused map[int64]*heldRequest
+}
+
+type heldRequest struct {
+	view    PausedRequest
+	release chan BreakpointEdit
+}
+
+// PausedRequest is a request held at a breakpoint.
+type PausedRequest struct {
+	ID           int64             `json:"id"`
+	EntryID      int64             `json:"entryId,omitempty"`
+	PausedAt     time.Time         `json:"pausedAt"`
+	Method       string            `json:"method"`
+	URL          string            `json:"url"`
+	Target       string            `json:"target"`
+	Headers      map[string]string `json:"headers"`
+	Body         string            `json:"body,omitempty"`
+	BodyEncoding string            `json:"bodyEncoding,omitempty"`
+}
+
+// BreakpointEdit changes a held request before it is forwarded. Zero fields
+// leave the request as it was.
+type BreakpointEdit struct {
+	Method string `json:"method,omitempty"`
+	// Headers sets each header to its value, or removes it when the value
+	// is empty.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body replaces the request body.
+	Body *string `json:"body,omitempty"`
+}
+
+// matches reports whether r should be held.
+func (b *Breakpoints) matches(r *http.Request) bool {
+	return b != nil && b.Pattern != nil && b.Pattern.MatchString(r.URL.Path)
+}
+
+// hold blocks until the request described by paused is continued, Timeout
+// passes or ctx is done, and returns the edit to apply. It reports false
+// when ctx ended first.
+func (b *Breakpoints) hold(ctx context.Context, paused PausedRequest) (BreakpointEdit, bool) {
+	held := &heldRequest{view: paused, release: make(chan BreakpointEdit, 1)}
+	b.mu.Lock()
+	b.nextID++
+	held.view.ID = b.nextID
+	if b.paused == nil {
+		b.paused = make(map[int64]*heldRequest)
+	}
+	b.paused[held.view.ID] = held
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.paused, held.view.ID)
+		b.mu.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if b.Timeout > 0 {
+		timer := time.NewTimer(b.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case edit := <-held.release:
+		return edit, true
+	case <-timeout:
+		return BreakpointEdit{}, true
+	case <-ctx.Done():
+		return BreakpointEdit{}, false
+	}
+}
+
+// Paused lists the held requests, oldest first.
+func (b *Breakpoints) Paused() []PausedRequest {
+	result := []PausedRequest{}
+	if b == nil {
+		return result
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, held := range b.paused {
+		result = append(result, held.view)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// Continue releases the held request with the given id, applying edit. It
+// reports false if no such request is held.
+func (b *Breakpoints) Continue(id int64, edit BreakpointEdit) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	held, ok := b.paused[id]
+	delete(b.paused, id)
+	b.mu.Unlock()
+	if ok {
+		held.release <- edit
+	}
+	return ok
+}
+
+// apply makes the edit to r and returns the body to forward.
+func (e BreakpointEdit) apply(r *http.Request, body []byte) []byte {
+	if e.Method != "" {
+		r.Method = strings.ToUpper(e.Method)
+	}
+	for name, value := range e.Headers {
+		if value == "" {
+			r.Header.Del(name)
+		} else {
+			r.Header.Set(name, value)
+		}
+	}
+	if e.Body != nil {
+		body = []byte(*e.Body)
+		r.ContentLength = int64(len(body))
+	}
+	return body
+}
+
+// edited reports whether the edit changes anything.
+func (e BreakpointEdit) edited() bool {
+	return e.Method != "" || len(e.Headers) > 0 || e.Body != nil
+}
+
+// CircuitBreaker stops sending requests to a target host after Threshold
+// consecutive failures. Once Cooldown has passed, a single probe request is
+// let through; its outcome closes or reopens the breaker.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether a request to host may be sent now.
+func (b *CircuitBreaker) allow(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.hosts[host]
+	if !ok || state.failures < b.Threshold {
+		return true
+	}
+	if state.probing || time.Now().Before(state.openUntil) {
+		return false
+	}
+	state.probing = true
+	return true
+}
+
+// record updates the breaker for host with the outcome of a request.
+func (b *CircuitBreaker) record(host string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		delete(b.hosts, host)
+		return
+	}
+	if b.hosts == nil {
+		b.hosts = make(map[string]*breakerState)
+	}
+	state, ok := b.hosts[host]
+	if !ok {
+		state = &breakerState{}
+		b.hosts[host] = state
+	}
+	state.failures++
+	state.probing = false
+	if state.failures >= b.Threshold {
+		state.openUntil = time.Now().Add(b.Cooldown)
+	}
+}
+
+// breakerTransport fails fast with errCircuitOpen for hosts whose breaker
+// is open, and reports each outcome to the breaker.
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *CircuitBreaker
+	entry   *LogEntry
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if !t.breaker.allow(host) {
+		t.entry.SetCircuitOpen()
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, errCircuitOpen
+	}
+	resp, err := t.next.RoundTrip(req)
+	t.breaker.record(host, err != nil || resp.StatusCode >= 500)
+	return resp, err
+}
+
+// failoverTransport sends a request to each target in turn until one
+// succeeds. Requests that could not connect fail over for every method;
+// other errors and 5xx responses only for idempotent ones.
+type failoverTransport struct {
+	next           http.RoundTripper
+	targets        []*url.URL
+	inbound        *url.URL
+	useRequestPath bool
+	entry          *LogEntry
+	// headersFor returns the -target-header values for a target.
+	headersFor func(target *url.URL) http.Header
+	// insecure records that certificates are not verified, as with -insecure.
+	insecure bool
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for i := 0; ; i++ {
+		resp, err := t.next.RoundTrip(req)
+		t.entry.AddTargetAttempt(t.targets[i].String(), resp, err)
+		if i+1 == len(t.targets) || !shouldFailover(req.Method, resp, err) {
+			return resp, err
+		}
+		next, ok := t.requestFor(req, t.targets[i], t.targets[i+1])
+		if !ok {
+			return resp, err
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		req = next
+	}
+}
+
+// requestFor clones req, which was sent to previous, for target, rewinding
+// its body and swapping previous's target headers for target's. It reports
+// false when the request cannot be sent again.
+func (t *failoverTransport) requestFor(req *http.Request, previous, target *url.URL) (*http.Request, bool) {
+	if req.Context().Err() != nil {
+		return nil, false
+	}
+	next := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, false
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, false
+		}
+		next.Body = body
+	}
+	next.URL = upstreamURL(t.inbound, target, t.useRequestPath)
+	next.Host = target.Host
+	if t.headersFor != nil {
+		for name := range t.headersFor(previous) {
+			next.Header.Del(name)
+		}
+		if headers := t.headersFor(target); headers != nil {
+			for name, values := range headers {
+				next.Header[name] = slices.Clone(values)
+			}
+			t.entry.SetInjectedHeaders(headers)
+		}
+	}
+	t.entry.SetTarget(target.String())
+	t.entry.SetUpstreamURL(next.URL.String())
+	if t.insecure && next.URL.Scheme == "https" {
+		t.entry.SetTLSVerifySkipped()
+	}
+	return next, true
+}
+
+// shouldFailover reports whether a request may be sent to the next target.
+// Requests that the target may have acted on are only sent again when their
+// method is idempotent, so a POST that reached a target before its
+// connection dropped never runs twice.
+func shouldFailover(method string, resp *http.Response, err error) bool {
+	if err != nil && requestNotSent(err) {
+		return true
+	}
+	return isIdempotentMethod(method) && (err != nil || resp.StatusCode >= 500)
+}
+
+// requestNotSent reports whether err shows that a request never reached
+// its target: the connection could not be made, or the circuit breaker
+// refused it.
+func requestNotSent(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, errCircuitOpen) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// maxCookieJars bounds the number of client IPs a cookieJars keeps jars
+// for.
+const maxCookieJars = 1000
+
+// cookieJars holds a cookie jar per client IP. When it holds maxCookieJars
+// jars, the least recently used one is dropped to make room for a new
+// client. The zero value is ready to use.
+type cookieJars struct {
+	mu   sync.Mutex
+	jars map[string]*clientCookieJar
+	// uses counts calls to forClient, ordering jars by their last use.
+	uses uint64
+}
+
+type clientCookieJar struct {
+	jar     http.CookieJar
+	lastUse uint64
+}
+
+func (c *cookieJars) forClient(clientIP string) http.CookieJar {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.uses++
+	if client, ok := c.jars[clientIP]; ok {
+		client.lastUse = c.uses
+		return client.jar
+	}
+	if c.jars == nil {
+		c.jars = make(map[string]*clientCookieJar)
+	}
+	if len(c.jars) >= maxCookieJars {
+		c.evict()
+	}
+	// cookiejar.New only fails for invalid options.
+	jar, _ := cookiejar.New(nil)
+	c.jars[clientIP] = &clientCookieJar{jar: jar, lastUse: c.uses}
+	return jar
+}
+
+// existing returns the jar of clientIP, or nil if it has none yet. Unlike
+// forClient, it neither creates a jar nor counts as a use.
+func (c *cookieJars) existing(clientIP string) http.CookieJar {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.jars[clientIP]; ok {
+		return client.jar
+	}
+	return nil
+}
+
+// evict drops the least recently used jar. The caller must hold c.mu.
+func (c *cookieJars) evict() {
+	var oldest string
+	for clientIP, client := range c.jars {
+		if oldest == "" || client.lastUse < c.jars[oldest].lastUse {
+			oldest = clientIP
+		}
+	}
+	delete(c.jars, oldest)
+}
+
+// jarAddsCookies reports whether the cookie jar of clientIP holds cookies
+// for u that r does not already carry.
+func (h *ProxyHandler) jarAddsCookies(r *http.Request, u *url.URL, clientIP string) bool {
+	if !h.CookieJar {
+		return false
+	}
+	jar := h.cookieJars.existing(clientIP)
+	if jar == nil {
+		return false
+	}
+	for _, cookie := range jar.Cookies(u) {
+		if _, err := r.Cookie(cookie.Name); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// cookieJarTransport adds cookies from jar that the request does not already
+// carry, and stores the cookies set by the response.
+type cookieJarTransport struct {
+	next  http.RoundTripper
+	jar   http.CookieJar
+	entry *LogEntry
+}
+
+func (t *cookieJarTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var applied []string
+	for _, cookie := range t.jar.Cookies(req.URL) {
+		if _, err := req.Cookie(cookie.Name); err == nil {
+			continue
+		}
+		if len(applied) == 0 {
+			req = req.Clone(req.Context())
+		}
+		req.AddCookie(cookie)
+		applied = append(applied, cookie.Name)
+	}
+	if len(applied) > 0 {
+		t.entry.SetAutoCookies(applied)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		t.jar.SetCookies(req.URL, resp.Cookies())
+	}
+	return resp, err
+}
+
+// maxRetryAfterWait caps how long retryAfterTransport waits before retrying.
+const maxRetryAfterWait = 30 * time.Second
+
+// retryAfterTransport retries a request once when the upstream answers 429
+// Too Many Requests with a Retry-After header.
+type retryAfterTransport struct {
+	next  http.RoundTripper
+	entry *LogEntry
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok || wait > maxRetryAfterWait {
+		return resp, err
+	}
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, err
+		}
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return resp, err
+		}
+		retry.Body = body
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+		return resp, err
+	}
+	_ = resp.Body.Close()
+	t.entry.SetRetriedAfter()
+	return t.next.RoundTrip(retry)
+}
+
+// parseRetryAfter parses a Retry-After value given either as seconds or as
+// an HTTP date, returning the delay relative to now.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(date.Sub(now), 0), true
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// LoadClientCertificate loads the PEM certificate and key presented to
+// targets that require mutual TLS. Both files must be given.
+func LoadClientCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return tls.Certificate{}, errors.New("-client-cert and -client-key must be set together")
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+func ParseUpstreamProxy(value string) (*url.URL, error) {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return nil, errors.New("upstream proxy must include a host")
+	}
+	return parsed, nil
+}
+
+type LogEntry struct {
+	ID                    int64             `json:"id"`
+	StartedAt             time.Time         `json:"startedAt"`
+	DurationMillis        int64             `json:"durationMillis"`
+	ClientIP              string            `json:"clientIp"`
+	SessionID             string            `json:"sessionId,omitempty"`
+	Method                string            `json:"method"`
+	URL                   string            `json:"url"`
+	Proto                 string            `json:"proto"`
+	RequestURI            string            `json:"requestUri"`
+	Target                string            `json:"target"`
+	Status                int               `json:"status"`
+	RequestHeaders        map[string]string `json:"requestHeaders"`
+	ResponseHeaders       map[string]string `json:"responseHeaders"`
+	ResponseTrailers      map[string]string `json:"responseTrailers,omitempty"`
+	RequestBody           string            `json:"requestBody"`
+	RequestBodyEncoding   string            `json:"requestBodyEncoding"`
+	RequestBodyTruncated  bool              `json:"requestBodyTruncated"`
+	ResponseBody          string            `json:"responseBody"`
+	ResponseBodyEncoding  string            `json:"responseBodyEncoding"`
+	ResponseBodyTruncated bool              `json:"responseBodyTruncated"`
+	// ResponseBodyDecoded reports whether ResponseBody was decompressed
+	// from ResponseBodyOriginalEncoding for display.
+	ResponseBodyDecoded          bool   `json:"responseBodyDecoded"`
+	ResponseBodyOriginalEncoding string `json:"responseBodyOriginalEncoding,omitempty"`
+	// RequestBodyLanguage and ResponseBodyLanguage hint which highlighter
+	// to use: json, xml, html, text or binary.
+	RequestBodyLanguage   string            `json:"requestBodyLanguage,omitempty"`
+	ResponseBodyLanguage  string            `json:"responseBodyLanguage,omitempty"`
+	Error                 string            `json:"error,omitempty"`
+	RequestContentType    string            `json:"requestContentType"`
+	ResponseContentType   string            `json:"responseContentType"`
+	RequestContentLength  int64             `json:"requestContentLength"`
+	ResponseContentLength int64             `json:"responseContentLength"`
+	UpstreamURL           string            `json:"upstreamUrl,omitempty"`
+	UpstreamAddr          string            `json:"upstreamAddr,omitempty"`
+	UpstreamViaProxy      bool              `json:"upstreamViaProxy,omitempty"`
+	Retries               int               `json:"retries,omitempty"`
+	RequestParts          []MultipartPart   `json:"requestParts,omitempty"`
+	RequestForm           url.Values        `json:"requestForm,omitempty"`
+	GraphQLOperation      *GraphQLOperation `json:"graphqlOperation,omitempty"`
+	Note                  string            `json:"note,omitempty"`
+	Pinned                bool              `json:"pinned"`
+	BodiesDropped         bool              `json:"bodiesDropped,omitempty"`
+	CoalescedCount        int               `json:"coalescedCount,omitempty"`
+	BodyCaptureSkipped    bool              `json:"bodyCaptureSkipped,omitempty"`
+	TargetAttempts        []TargetAttempt   `json:"targetAttempts,omitempty"`
+	CircuitOpen           bool              `json:"circuitOpen,omitempty"`
+	ResponseBodyOmitted   bool              `json:"responseBodyOmitted,omitempty"`
+	Mocked                bool              `json:"mocked,omitempty"`
+	DNSMillis             float64           `json:"dnsMillis,omitempty"`
+	ConnectMillis         float64           `json:"connectMillis,omitempty"`
+	TLSHandshakeMillis    float64           `json:"tlsHandshakeMillis,omitempty"`
+	RetryAfterSeconds     int64             `json:"retryAfterSeconds,omitempty"`
+	RetriedAfter          bool              `json:"retriedAfter,omitempty"`
+	AutoCookies           []string          `json:"autoCookies,omitempty"`
+	SchemaErrors          []string          `json:"schemaErrors,omitempty"`
+	UpstreamStatus        int               `json:"upstreamStatus,omitempty"`
+	UpstreamTLS           *UpstreamTLS      `json:"upstreamTls,omitempty"`
+	TLSVerifySkipped      bool              `json:"tlsVerifySkipped,omitempty"`
+	// RequestHeaderValues and ResponseHeaderValues hold the individual
+	// values of headers sent more than once, which RequestHeaders and
+	// ResponseHeaders join with commas, so each Set-Cookie stays intact.
+	RequestHeaderValues  map[string][]string `json:"requestHeaderValues,omitempty"`
+	ResponseHeaderValues map[string][]string `json:"responseHeaderValues,omitempty"`
+	// RequestBodySkipped reports that the request body was streamed
+	// through uncaptured because of ProxyHandler.CaptureBodyMethods.
+	RequestBodySkipped bool `json:"requestBodySkipped,omitempty"`
+	// RequestBodyRedacted reports that -redact-body-keys replaced values in
+	// the captured request body, so it differs from the body that was sent.
+	RequestBodyRedacted bool `json:"requestBodyRedacted,omitempty"`
+	// ExpectContinue reports that the client sent Expect: 100-continue,
+	// and Continued that the target replied with 100 Continue before the
+	// body was sent.
+	ExpectContinue bool `json:"expectContinue,omitempty"`
+	Continued      bool `json:"continued,omitempty"`
+	// CacheHit reports that the response was served from -cache-mode
+	// replay or the -cache HTTP cache without contacting the target.
+	CacheHit bool `json:"cacheHit,omitempty"`
+	// QueueMillis is how long the request waited for a -max-concurrency
+	// slot before being forwarded or rejected.
+	QueueMillis float64 `json:"queueMillis,omitempty"`
+	// ContentLengthMismatch reports that the response body read from the
+	// target did not match its declared Content-Length.
+	// DeclaredContentLength and ReceivedContentLength give both lengths.
+	ContentLengthMismatch bool  `json:"contentLengthMismatch,omitempty"`
+	DeclaredContentLength int64 `json:"declaredContentLength,omitempty"`
+	ReceivedContentLength int64 `json:"receivedContentLength,omitempty"`
+	// BreakpointMillis is how long the request was held at a breakpoint,
+	// and BreakpointEdited reports that it was edited there.
+	BreakpointMillis float64 `json:"breakpointMillis,omitempty"`
+	BreakpointEdited bool    `json:"breakpointEdited,omitempty"`
+	// ResolutionMethod names the TargetResolver rule that chose the
+	// target, one of the ResolvedBy constants.
+	ResolutionMethod string `json:"resolutionMethod,omitempty"`
+	// RequestBodyFile and ResponseBodyFile name the files in -body-dir
+	// holding bodies too large to keep inline. The inline body is empty.
+	RequestBodyFile  string `json:"requestBodyFile,omitempty"`
+	ResponseBodyFile string `json:"responseBodyFile,omitempty"`
+	// DelayMillis is the -delay injected before the request was forwarded.
+	DelayMillis float64 `json:"delayMillis,omitempty"`
+
+	// omitBodyTypes is copied from LogStore.OmitBodyTypes.
+	omitBodyTypes []string
+	// redactBodyKeys is copied from LogStore.RedactBodyKeys.
+	redactBodyKeys []string
+	// sortJSONKeys is copied from LogStore.SortJSONKeys.
+	sortJSONKeys bool
+	// bodyDir and bodyFileThreshold are copied from LogStore.BodyDir and
+	// LogStore.BodyFileThreshold.
+	bodyDir           string
+	bodyFileThreshold int
+	// bodyLimit is copied from LogStore.MaxBodyLogSize, or raised for
+	// VerbosePath requests. DefaultMaxBodyLogSize is used when it is 0.
+	bodyLimit int
+	// accountedBytes is the body size counted against the store's budget.
+	// It is guarded by the store's mutex, not the entry's.
+	accountedBytes int64
+
+	mu sync.Mutex
+}
+
+// MultipartPart summarizes a single part of a multipart/form-data body.
+type MultipartPart struct {
+	Name        string `json:"name"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size"`
+}
+
+// TargetAttempt records one upstream attempt made while failing over
+// between targets.
+type TargetAttempt struct {
+	Target string `json:"target"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type LogEntryView struct {
+	ID                    int64             `json:"id"`
+	StartedAt             time.Time         `json:"startedAt"`
+	DurationMillis        int64             `json:"durationMillis"`
+	ClientIP              string            `json:"clientIp"`
+	SessionID             string            `json:"sessionId,omitempty"`
+	Method                string            `json:"method"`
+	URL                   string            `json:"url"`
+	Proto                 string            `json:"proto"`
+	RequestURI            string            `json:"requestUri"`
+	Target                string            `json:"target"`
+	Status                int               `json:"status"`
+	RequestHeaders        map[string]string `json:"requestHeaders"`
+	ResponseHeaders       map[string]string `json:"responseHeaders"`
+	ResponseTrailers      map[string]string `json:"responseTrailers,omitempty"`
+	RequestBody           string            `json:"requestBody"`
+	RequestBodyEncoding   string            `json:"requestBodyEncoding"`
+	RequestBodyTruncated  bool              `json:"requestBodyTruncated"`
+	ResponseBody          string            `json:"responseBody"`
+	ResponseBodyEncoding  string            `json:"responseBodyEncoding"`
+	ResponseBodyTruncated bool              `json:"responseBodyTruncated"`
+	// ResponseBodyDecoded reports whether ResponseBody was decompressed
+	// from ResponseBodyOriginalEncoding for display.
+	ResponseBodyDecoded          bool   `json:"responseBodyDecoded"`
+	ResponseBodyOriginalEncoding string `json:"responseBodyOriginalEncoding,omitempty"`
+	// RequestBodyLanguage and ResponseBodyLanguage hint which highlighter
+	// to use: json, xml, html, text or binary.
+	RequestBodyLanguage   string            `json:"requestBodyLanguage,omitempty"`
+	ResponseBodyLanguage  string            `json:"responseBodyLanguage,omitempty"`
+	Error                 string            `json:"error,omitempty"`
+	RequestContentType    string            `json:"requestContentType"`
+	ResponseContentType   string            `json:"responseContentType"`
+	RequestContentLength  int64             `json:"requestContentLength"`
+	ResponseContentLength int64             `json:"responseContentLength"`
+	UpstreamURL           string            `json:"upstreamUrl,omitempty"`
+	UpstreamAddr          string            `json:"upstreamAddr,omitempty"`
+	UpstreamViaProxy      bool              `json:"upstreamViaProxy,omitempty"`
+	Retries               int               `json:"retries,omitempty"`
+	RequestParts          []MultipartPart   `json:"requestParts,omitempty"`
+	RequestForm           url.Values        `json:"requestForm,omitempty"`
+	GraphQLOperation      *GraphQLOperation `json:"graphqlOperation,omitempty"`
+	Note                  string            `json:"note,omitempty"`
+	Pinned                bool              `json:"pinned"`
+	BodiesDropped         bool              `json:"bodiesDropped,omitempty"`
+	CoalescedCount        int               `json:"coalescedCount,omitempty"`
+	BodyCaptureSkipped    bool              `json:"bodyCaptureSkipped,omitempty"`
+	TargetAttempts        []TargetAttempt   `json:"targetAttempts,omitempty"`
+	CircuitOpen           bool              `json:"circuitOpen,omitempty"`
+	ResponseBodyOmitted   bool              `json:"responseBodyOmitted,omitempty"`
+	Mocked                bool              `json:"mocked,omitempty"`
+	DNSMillis             float64           `json:"dnsMillis,omitempty"`
+	ConnectMillis         float64           `json:"connectMillis,omitempty"`
+	TLSHandshakeMillis    float64           `json:"tlsHandshakeMillis,omitempty"`
+	RetryAfterSeconds     int64             `json:"retryAfterSeconds,omitempty"`
+	RetriedAfter          bool              `json:"retriedAfter,omitempty"`
+	AutoCookies           []string          `json:"autoCookies,omitempty"`
+	SchemaErrors          []string          `json:"schemaErrors,omitempty"`
+	UpstreamStatus        int               `json:"upstreamStatus,omitempty"`
+	UpstreamTLS           *UpstreamTLS      `json:"upstreamTls,omitempty"`
+	TLSVerifySkipped      bool              `json:"tlsVerifySkipped,omitempty"`
+	// RequestHeaderValues and ResponseHeaderValues hold the individual
+	// values of headers sent more than once, which RequestHeaders and
+	// ResponseHeaders join with commas, so each Set-Cookie stays intact.
+	RequestHeaderValues  map[string][]string `json:"requestHeaderValues,omitempty"`
+	ResponseHeaderValues map[string][]string `json:"responseHeaderValues,omitempty"`
+	// RequestBodySkipped reports that the request body was streamed
+	// through uncaptured because of ProxyHandler.CaptureBodyMethods.
+	RequestBodySkipped bool `json:"requestBodySkipped,omitempty"`
+	// RequestBodyRedacted reports that -redact-body-keys replaced values in
+	// the captured request body, so it differs from the body that was sent.
+	RequestBodyRedacted bool `json:"requestBodyRedacted,omitempty"`
+	// ExpectContinue reports that the client sent Expect: 100-continue,
+	// and Continued that the target replied with 100 Continue before the
+	// body was sent.
+	ExpectContinue bool `json:"expectContinue,omitempty"`
+	Continued      bool `json:"continued,omitempty"`
+	// CacheHit reports that the response was served from -cache-mode
+	// replay or the -cache HTTP cache without contacting the target.
+	CacheHit bool `json:"cacheHit,omitempty"`
+	// QueueMillis is how long the request waited for a -max-concurrency
+	// slot before being forwarded or rejected.
+	QueueMillis float64 `json:"queueMillis,omitempty"`
+	// ContentLengthMismatch reports that the response body read from the
+	// target did not match its declared Content-Length.
+	// DeclaredContentLength and ReceivedContentLength give both lengths.
+	ContentLengthMismatch bool  `json:"contentLengthMismatch,omitempty"`
+	DeclaredContentLength int64 `json:"declaredContentLength,omitempty"`
+	ReceivedContentLength int64 `json:"receivedContentLength,omitempty"`
+	// BreakpointMillis is how long the request was held at a breakpoint,
+	// and BreakpointEdited reports that it was edited there.
+	BreakpointMillis float64 `json:"breakpointMillis,omitempty"`
+	BreakpointEdited bool    `json:"breakpointEdited,omitempty"`
+	// ResolutionMethod names the TargetResolver rule that chose the
+	// target, one of the ResolvedBy constants.
+	ResolutionMethod string `json:"resolutionMethod,omitempty"`
+	// RequestBodyFile and ResponseBodyFile name the files in -body-dir
+	// holding bodies too large to keep inline. The inline body is empty.
+	RequestBodyFile  string `json:"requestBodyFile,omitempty"`
+	ResponseBodyFile string `json:"responseBodyFile,omitempty"`
+	// DelayMillis is the -delay injected before the request was forwarded.
+	DelayMillis float64 `json:"delayMillis,omitempty"`
+}
+
+func (e *LogEntry) SetTarget(target string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Target = target
+}
+
+func (e *LogEntry) SetUpstreamURL(upstreamURL string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.UpstreamURL = upstreamURL
+}
+
+func (e *LogEntry) SetDNSDuration(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.DNSMillis = durationMillis(d)
+}
+
+func (e *LogEntry) SetConnectDuration(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ConnectMillis = durationMillis(d)
+}
+
+// SetQueueDuration records how long the request waited for a
+// -max-concurrency slot.
+func (e *LogEntry) SetQueueDuration(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.QueueMillis = durationMillis(d)
+}
+
+// SetInjectedDelay records the -delay applied before forwarding.
+func (e *LogEntry) SetInjectedDelay(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.DelayMillis = durationMillis(d)
+}
+
+// SetContentLengthMismatch flags a response whose body length differs from
+// its declared Content-Length and records both lengths.
+func (e *LogEntry) SetContentLengthMismatch(declared int64, actual int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ContentLengthMismatch = true
+	e.DeclaredContentLength = declared
+	e.ReceivedContentLength = int64(actual)
+}
+
+func (e *LogEntry) SetTLSHandshakeDuration(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.TLSHandshakeMillis = durationMillis(d)
+}
+
+// SetResolutionMethod records which TargetResolver rule chose the target.
+func (e *LogEntry) SetResolutionMethod(method string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ResolutionMethod = method
+}
+
+// SetBreakpointDuration records how long the request was held at a
+// breakpoint.
+func (e *LogEntry) SetBreakpointDuration(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.BreakpointMillis = durationMillis(d)
+}
+
+// SetEditedRequest replaces the captured method and headers with those of a
+// request edited at a breakpoint.
+func (e *LogEntry) SetEditedRequest(method string, headers http.Header) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.BreakpointEdited = true
+	e.Method = method
+	e.RequestHeaders = flattenHeaders(headers)
+	e.RequestHeaderValues = multiValueHeaders(headers)
+	dropTargetSignature(e.RequestHeaders, e.RequestHeaderValues)
+}
+
+// SetInjectedHeaders records headers added to the forwarded request,
+// replacing any captured values of the same name.
+func (e *LogEntry) SetInjectedHeaders(headers http.Header) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.RequestHeaders == nil {
+		e.RequestHeaders = make(map[string]string, len(headers))
+	}
+	for name, value := range flattenHeaders(headers) {
+		for key := range e.RequestHeaders {
+			if strings.EqualFold(key, name) {
+				delete(e.RequestHeaders, key)
+				delete(e.RequestHeaderValues, key)
+			}
+		}
+		e.RequestHeaders[name] = value
+	}
+	for name, values := range multiValueHeaders(headers) {
+		if e.RequestHeaderValues == nil {
+			e.RequestHeaderValues = make(map[string][]string)
+		}
+		e.RequestHeaderValues[name] = values
+	}
+}
+
+// SetUpstreamTLS records the target's TLS connection details.
+func (e *LogEntry) SetUpstreamTLS(summary *UpstreamTLS) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.UpstreamTLS = summary
+}
+
+// SetTLSVerifySkipped records that the target's certificate was not
+// verified.
+func (e *LogEntry) SetTLSVerifySkipped() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.TLSVerifySkipped = true
+}
+
+// UpstreamTLS summarizes the TLS connection to a target.
+type UpstreamTLS struct {
+	Version      string               `json:"version"`
+	CipherSuite  string               `json:"cipherSuite"`
+	ServerName   string               `json:"serverName,omitempty"`
+	Certificates []CertificateSummary `json:"certificates"`
+	// Error is set when the chain failed verification.
+	Error string `json:"error,omitempty"`
+}
+
+// CertificateSummary describes one certificate of a presented chain.
+type CertificateSummary struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// summarizeTLS describes state and the certificate chain presented in it,
+// leaf first.
+func summarizeTLS(state tls.ConnectionState, chain []*x509.Certificate) *UpstreamTLS {
+	summary := &UpstreamTLS{ServerName: state.ServerName}
+	if state.Version != 0 {
+		summary.Version = tls.VersionName(state.Version)
+		summary.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	}
+	for _, cert := range chain {
+		summary.Certificates = append(summary.Certificates, CertificateSummary{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			DNSNames:  cert.DNSNames,
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+		})
+	}
+	return summary
+}
+
+// durationMillis converts d to fractional milliseconds.
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (e *LogEntry) SetUpstreamAddr(addr string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.UpstreamAddr = addr
+}
+
+// SetUpstreamViaProxy records that the request was sent through an
+// upstream proxy, whose address UpstreamAddr then holds.
+func (e *LogEntry) SetUpstreamViaProxy() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.UpstreamViaProxy = true
+}
+
+func (e *LogEntry) SetRetries(retries int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Retries = retries
+}
+
+func (e *LogEntry) SetRequestBody(body []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.RequestContentLength = int64(len(body))
+	e.RequestContentType = http.DetectContentType(body)
+	contentType := lookupHeader(e.RequestHeaders, "Content-Type")
+	if contentType == "" {
+		contentType = e.RequestContentType
+	}
+	redacted := redactJSONBody(body, contentType, e.redactBodyKeys)
+	e.RequestBodyRedacted = !bytes.Equal(redacted, body)
+	body = redacted
+	if e.sortJSONKeys {
+		body = canonicalJSONBody(body, contentType)
+	}
+	if name, ok := e.writeBodyFile("request", body); ok {
+		e.RequestBodyFile = name
+		e.RequestBodyLanguage = bodyLanguage(contentType, "")
+		return
+	}
+	e.RequestBody, e.RequestBodyEncoding, e.RequestBodyTruncated = formatBody(body, e.captureLimit())
+	e.RequestBodyLanguage = bodyLanguage(contentType, e.RequestBodyEncoding)
+}
+
+// SetRequestParts records a multipart request as a summary of its parts
+// rather than the raw body.
+func (e *LogEntry) SetRequestParts(contentType string, body []byte, parts []MultipartPart) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.RequestContentLength = int64(len(body))
+	e.RequestContentType = contentType
+	e.RequestParts = parts
+}
+
+func (e *LogEntry) SetRequestForm(form url.Values) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.RequestForm = form
+}
+
+// SetGraphQLOperation records the GraphQL operation sent in the request.
+func (e *LogEntry) SetGraphQLOperation(operation *GraphQLOperation) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.GraphQLOperation = operation
+}
+
+func (e *LogEntry) SetNote(note string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Note = note
+}
+
+func (e *LogEntry) SetPinned(pinned bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Pinned = pinned
+}
+
+func (e *LogEntry) IsPinned() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.Pinned
+}
+
+// Failed reports whether the exchange ended in an error or a 5xx status.
+func (e *LogEntry) Failed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.Error != "" || e.Status >= 500
+}
+
+func (e *LogEntry) bodySize() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return int64(len(e.RequestBody) + len(e.ResponseBody))
+}
+
+// dropBodies discards the captured bodies while keeping all metadata.
+func (e *LogEntry) dropBodies() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.RequestBody = ""
+	e.ResponseBody = ""
+	e.BodiesDropped = true
+}
+
+// AddTargetAttempt records the outcome of sending the request to target.
+func (e *LogEntry) AddTargetAttempt(target string, resp *http.Response, err error) {
+	attempt := TargetAttempt{Target: target}
+	if err != nil {
+		attempt.Error = err.Error()
+	} else {
+		attempt.Status = resp.StatusCode
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.TargetAttempts = append(e.TargetAttempts, attempt)
+}
+
+// SetCacheHit records that the response was served from a cache.
+func (e *LogEntry) SetCacheHit() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.CacheHit = true
+}
+
+// SetMocked records that the response came from a mock rule.
+func (e *LogEntry) SetMocked() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Mocked = true
+}
+
+// SetCircuitOpen records that an open circuit breaker rejected the request.
+func (e *LogEntry) SetCircuitOpen() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.CircuitOpen = true
+}
+
+// AddCoalesced records that another request shared this entry's response.
+func (e *LogEntry) AddCoalesced() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.CoalescedCount++
+}
+
+// SkipBodyCapture records request metadata for a request whose bodies are
+// not captured.
+func (e *LogEntry) SkipBodyCapture(contentType string, contentLength int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.BodyCaptureSkipped = true
+	e.RequestContentType = contentType
+	e.RequestContentLength = max(contentLength, 0)
+}
+
+// SkipRequestBodyCapture records request metadata for a request whose body
+// is streamed through without being captured.
+func (e *LogEntry) SkipRequestBodyCapture(contentType string, contentLength int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.RequestBodySkipped = true
+	e.RequestContentType = contentType
+	e.RequestContentLength = max(contentLength, 0)
+}
+
+// SetExpectContinue records that the client sent Expect: 100-continue.
+func (e *LogEntry) SetExpectContinue() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ExpectContinue = true
+}
+
+// SetContinued records that the target answered Expect: 100-continue with
+// 100 Continue.
+func (e *LogEntry) SetContinued() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Continued = true
+}
+
+// SetResponseMetadata records the response status and headers without its body.
+func (e *LogEntry) SetResponseMetadata(resp *http.Response) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Status = resp.StatusCode
+	e.ResponseContentLength = max(resp.ContentLength, 0)
+	e.ResponseContentType = resp.Header.Get("Content-Type")
+	e.ResponseHeaders = flattenHeaders(resp.Header)
+	e.ResponseHeaderValues = multiValueHeaders(resp.Header)
+	e.setRetryAfter(resp.Header)
+}
+
+// setRetryAfter records the response's Retry-After delay, rounded up to
+// whole seconds. The caller must hold e.mu.
+func (e *LogEntry) setRetryAfter(headers http.Header) {
+	if wait, ok := parseRetryAfter(headers.Get("Retry-After"), time.Now()); ok {
+		e.RetryAfterSeconds = int64((wait + time.Second - 1) / time.Second)
+	}
+}
+
+// SetUpstreamStatus records the target's real status when the response
+// status is overridden.
+func (e *LogEntry) SetUpstreamStatus(status int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.UpstreamStatus = status
+}
+
+// SetSchemaErrors records the response's JSON Schema violations.
+func (e *LogEntry) SetSchemaErrors(errs []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.SchemaErrors = errs
+}
+
+// SetAutoCookies records the names of cookies added from the cookie jar.
+func (e *LogEntry) SetAutoCookies(names []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.AutoCookies = names
+}
+
+// SetRetriedAfter records that the request was retried after honoring a
+// Retry-After delay.
+func (e *LogEntry) SetRetriedAfter() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.RetriedAfter = true
+}
+
+// SetResponse records the response status, headers and body. Trailers are
+// recorded too, so it must be called after the body has been read.
+func (e *LogEntry) SetResponse(resp *http.Response, body []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Status = resp.StatusCode
+	e.ResponseContentLength = int64(len(body))
+	e.ResponseContentType = resp.Header.Get("Content-Type")
+	e.ResponseHeaders = flattenHeaders(resp.Header)
+	if len(resp.Trailer) > 0 {
+		e.ResponseTrailers = flattenHeaders(resp.Trailer)
+	}
+	e.ResponseHeaderValues = multiValueHeaders(resp.Header)
+	e.setRetryAfter(resp.Header)
+
+	bodyToFormat, originalEncoding := decodeResponseBody(resp.Header, body)
+	e.ResponseBodyDecoded = originalEncoding != ""
+	e.ResponseBodyOriginalEncoding = originalEncoding
+
+	if matchesContentType(e.omitBodyTypes, e.ResponseContentType) {
+		e.ResponseBody = fmt.Sprintf("[binary, %d bytes]", len(bodyToFormat))
+		e.ResponseBodyEncoding = "utf-8"
+		e.ResponseBodyOmitted = true
+		e.ResponseBodyLanguage = "binary"
+		return
+	}
+
+	bodyToFormat = redactJSONBody(bodyToFormat, e.ResponseContentType, e.redactBodyKeys)
+	if e.sortJSONKeys {
+		bodyToFormat = canonicalJSONBody(bodyToFormat, e.ResponseContentType)
+	}
+	if name, ok := e.writeBodyFile("response", bodyToFormat); ok {
+		e.ResponseBodyFile = name
+		e.ResponseBodyLanguage = bodyLanguage(e.ResponseContentType, "")
+		return
+	}
+	e.ResponseBody, e.ResponseBodyEncoding, e.ResponseBodyTruncated = formatBody(bodyToFormat, e.captureLimit())
+	e.ResponseBodyLanguage = bodyLanguage(e.ResponseContentType, e.ResponseBodyEncoding)
+}
+
+// bodyFileName matches the names writeBodyFile gives body files.
+var bodyFileName = regexp.MustCompile(`^\d+-(request|response)\.body$`)
+
+// writeBodyFile stores a body larger than the -body-dir threshold in its own
+// file and returns the file's name within the directory. It reports false
+// when the body should be kept inline. The caller must hold e.mu.
+func (e *LogEntry) writeBodyFile(side string, body []byte) (string, bool) {
+	if e.bodyDir == "" || e.ID == 0 || len(body) <= e.bodyFileThreshold {
+		return "", false
+	}
+	name := fmt.Sprintf("%d-%s.body", e.ID, side)
+	if err := os.WriteFile(filepath.Join(e.bodyDir, name), body, 0o600); err != nil {
+		log.Printf("body dir: %v", err)
+		return "", false
+	}
+	return name, true
+}
+
+// removeBodyFiles deletes the files written by writeBodyFile.
+func (e *LogEntry) removeBodyFiles() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, name := range []string{e.RequestBodyFile, e.ResponseBodyFile} {
+		if name != "" && e.bodyDir != "" {
+			_ = os.Remove(filepath.Join(e.bodyDir, name))
+		}
+	}
+}
+
+// captureLimit returns the number of body bytes stored before truncating
+// entries that are not VerbosePath requests.
+func (s *LogStore) captureLimit() int {
+	if s.MaxBodyLogSize > 0 {
+		return s.MaxBodyLogSize
+	}
+	return DefaultMaxBodyLogSize
+}
+
+// captureLimit returns the number of body bytes stored before truncating.
+func (e *LogEntry) captureLimit() int {
+	if e.bodyLimit > 0 {
+		return e.bodyLimit
+	}
+	return DefaultMaxBodyLogSize
+}
+
+// ParseRedactKeys parses a comma-separated list of JSON keys, lower-cased
+// for case-insensitive matching.
+func ParseRedactKeys(value string) []string {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// redactJSONBody replaces the values of keys anywhere in a JSON body with
+// "***". Bodies that are not JSON, or contain none of the keys, are
+// returned unchanged so their formatting is kept.
+func redactJSONBody(body []byte, contentType string, keys []string) []byte {
+	if len(keys) == 0 || bodyLanguage(contentType, "") != "json" {
+		return body
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return body
+	}
+	if !redactJSONValue(document, keys) {
+		return body
+	}
+	redacted, err := marshalJSONUnescaped(document)
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+// canonicalJSONBody re-serializes a JSON body compactly with object keys in
+// sorted order. Other bodies, and JSON that fails to parse, are returned
+// unchanged.
+func canonicalJSONBody(body []byte, contentType string) []byte {
+	if bodyLanguage(contentType, "") != "json" || !json.Valid(body) {
+		return body
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return body
+	}
+	// encoding/json writes map keys in sorted order.
+	canonical, err := marshalJSONUnescaped(document)
+	if err != nil {
+		return body
+	}
+	return canonical
+}
+
+// marshalJSONUnescaped encodes value compactly without escaping <, > and &,
+// so re-encoded bodies stay close to what the client or target sent.
+func marshalJSONUnescaped(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// redactJSONValue redacts keys within value in place and reports whether
+// anything was replaced.
+func redactJSONValue(value any, keys []string) bool {
+	redacted := false
+	switch value := value.(type) {
+	case map[string]any:
+		for key, member := range value {
+			if slices.Contains(keys, strings.ToLower(key)) {
+				value[key] = "***"
+				redacted = true
+			} else if redactJSONValue(member, keys) {
+				redacted = true
+			}
+		}
+	case []any:
+		for _, item := range value {
+			if redactJSONValue(item, keys) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
+
+// DefaultOmitBodyTypes are the binary content types omitted by -omit-binary.
+const DefaultOmitBodyTypes = "image/*,video/*,audio/*,application/octet-stream,application/pdf"
+
+// matchesContentType reports whether contentType matches any of patterns.
+func matchesContentType(patterns []string, contentType string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// SetStatus records a status the proxy answered with itself.
+func (e *LogEntry) SetStatus(status int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Status = status
+}
+
+func (e *LogEntry) SetError(err string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Error = err
+}
+
+func (e *LogEntry) SetDurationSinceStart() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.DurationMillis = time.Since(e.StartedAt).Milliseconds()
+}
+
+func (e *LogEntry) Snapshot() LogEntryView {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return LogEntryView{
+		ID:                           e.ID,
+		StartedAt:                    e.StartedAt,
+		DurationMillis:               e.DurationMillis,
+		ClientIP:                     e.ClientIP,
+		SessionID:                    e.SessionID,
+		Method:                       e.Method,
+		URL:                          e.URL,
+		Proto:                        e.Proto,
+		RequestURI:                   e.RequestURI,
+		Target:                       e.Target,
+		Status:                       e.Status,
+		RequestHeaders:               cloneMap(e.RequestHeaders),
+		RequestHeaderValues:          cloneHeaderValues(e.RequestHeaderValues),
+		ResponseHeaders:              cloneMap(e.ResponseHeaders),
+		ResponseTrailers:             cloneMap(e.ResponseTrailers),
+		ResponseHeaderValues:         cloneHeaderValues(e.ResponseHeaderValues),
+		RequestBodySkipped:           e.RequestBodySkipped,
+		RequestBodyRedacted:          e.RequestBodyRedacted,
+		ExpectContinue:               e.ExpectContinue,
+		Continued:                    e.Continued,
+		CacheHit:                     e.CacheHit,
+		QueueMillis:                  e.QueueMillis,
+		ContentLengthMismatch:        e.ContentLengthMismatch,
+		DeclaredContentLength:        e.DeclaredContentLength,
+		ReceivedContentLength:        e.ReceivedContentLength,
+		BreakpointMillis:             e.BreakpointMillis,
+		BreakpointEdited:             e.BreakpointEdited,
+		ResolutionMethod:             e.ResolutionMethod,
+		RequestBodyFile:              e.RequestBodyFile,
+		ResponseBodyFile:             e.ResponseBodyFile,
+		DelayMillis:                  e.DelayMillis,
+		RequestBody:                  e.RequestBody,
+		RequestBodyEncoding:          e.RequestBodyEncoding,
+		RequestBodyTruncated:         e.RequestBodyTruncated,
+		ResponseBody:                 e.ResponseBody,
+		ResponseBodyEncoding:         e.ResponseBodyEncoding,
+		ResponseBodyTruncated:        e.ResponseBodyTruncated,
+		ResponseBodyDecoded:          e.ResponseBodyDecoded,
+		ResponseBodyOriginalEncoding: e.ResponseBodyOriginalEncoding,
+		RequestBodyLanguage:          e.RequestBodyLanguage,
+		ResponseBodyLanguage:         e.ResponseBodyLanguage,
+		Error:                        e.Error,
+		RequestContentType:           e.RequestContentType,
+		ResponseContentType:          e.ResponseContentType,
+		RequestContentLength:         e.RequestContentLength,
+		ResponseContentLength:        e.ResponseContentLength,
+		UpstreamURL:                  e.UpstreamURL,
+		UpstreamAddr:                 e.UpstreamAddr,
+		UpstreamViaProxy:             e.UpstreamViaProxy,
+		Retries:                      e.Retries,
+		RequestParts:                 append([]MultipartPart(nil), e.RequestParts...),
+		RequestForm:                  cloneValues(e.RequestForm),
+		GraphQLOperation:             e.GraphQLOperation,
+		Note:                         e.Note,
+		Pinned:                       e.Pinned,
+		BodiesDropped:                e.BodiesDropped,
+		CoalescedCount:               e.CoalescedCount,
+		BodyCaptureSkipped:           e.BodyCaptureSkipped,
+		TargetAttempts:               append([]TargetAttempt(nil), e.TargetAttempts...),
+		CircuitOpen:                  e.CircuitOpen,
+		ResponseBodyOmitted:          e.ResponseBodyOmitted,
+		Mocked:                       e.Mocked,
+		DNSMillis:                    e.DNSMillis,
+		ConnectMillis:                e.ConnectMillis,
+		TLSHandshakeMillis:           e.TLSHandshakeMillis,
+		RetryAfterSeconds:            e.RetryAfterSeconds,
+		RetriedAfter:                 e.RetriedAfter,
+		AutoCookies:                  append([]string(nil), e.AutoCookies...),
+		SchemaErrors:                 append([]string(nil), e.SchemaErrors...),
+		UpstreamStatus:               e.UpstreamStatus,
+		UpstreamTLS:                  e.UpstreamTLS,
+		TLSVerifySkipped:             e.TLSVerifySkipped,
+	}
+}
+
+// newEntryFromView rebuilds a detached entry from an exported view. Body
+// file references are not imported, since they name files on the exporting
+// machine.
+func newEntryFromView(view LogEntryView) *LogEntry {
+	return &LogEntry{
+		StartedAt:                    view.StartedAt,
+		DurationMillis:               view.DurationMillis,
+		ClientIP:                     view.ClientIP,
+		SessionID:                    view.SessionID,
+		Method:                       view.Method,
+		URL:                          view.URL,
+		Proto:                        view.Proto,
+		RequestURI:                   view.RequestURI,
+		Target:                       view.Target,
+		Status:                       view.Status,
+		RequestHeaders:               view.RequestHeaders,
+		RequestHeaderValues:          view.RequestHeaderValues,
+		ResponseHeaders:              view.ResponseHeaders,
+		ResponseTrailers:             view.ResponseTrailers,
+		ResponseHeaderValues:         view.ResponseHeaderValues,
+		RequestBodySkipped:           view.RequestBodySkipped,
+		RequestBodyRedacted:          view.RequestBodyRedacted,
+		ExpectContinue:               view.ExpectContinue,
+		Continued:                    view.Continued,
+		CacheHit:                     view.CacheHit,
+		QueueMillis:                  view.QueueMillis,
+		ContentLengthMismatch:        view.ContentLengthMismatch,
+		DeclaredContentLength:        view.DeclaredContentLength,
+		ReceivedContentLength:        view.ReceivedContentLength,
+		BreakpointMillis:             view.BreakpointMillis,
+		BreakpointEdited:             view.BreakpointEdited,
+		ResolutionMethod:             view.ResolutionMethod,
+		DelayMillis:                  view.DelayMillis,
+		RequestBody:                  view.RequestBody,
+		RequestBodyEncoding:          view.RequestBodyEncoding,
+		RequestBodyTruncated:         view.RequestBodyTruncated,
+		ResponseBody:                 view.ResponseBody,
+		ResponseBodyEncoding:         view.ResponseBodyEncoding,
+		ResponseBodyTruncated:        view.ResponseBodyTruncated,
+		ResponseBodyDecoded:          view.ResponseBodyDecoded,
+		ResponseBodyOriginalEncoding: view.ResponseBodyOriginalEncoding,
+		RequestBodyLanguage:          view.RequestBodyLanguage,
+		ResponseBodyLanguage:         view.ResponseBodyLanguage,
+		Error:                        view.Error,
+		RequestContentType:           view.RequestContentType,
+		ResponseContentType:          view.ResponseContentType,
+		RequestContentLength:         view.RequestContentLength,
+		ResponseContentLength:        view.ResponseContentLength,
+		UpstreamURL:                  view.UpstreamURL,
+		UpstreamAddr:                 view.UpstreamAddr,
+		UpstreamViaProxy:             view.UpstreamViaProxy,
+		Retries:                      view.Retries,
+		RequestParts:                 view.RequestParts,
+		RequestForm:                  view.RequestForm,
+		GraphQLOperation:             view.GraphQLOperation,
+		Note:                         view.Note,
+		Pinned:                       view.Pinned,
+		BodiesDropped:                view.BodiesDropped,
+		CoalescedCount:               view.CoalescedCount,
+		BodyCaptureSkipped:           view.BodyCaptureSkipped,
+		TargetAttempts:               view.TargetAttempts,
+		CircuitOpen:                  view.CircuitOpen,
+		ResponseBodyOmitted:          view.ResponseBodyOmitted,
+		Mocked:                       view.Mocked,
+		DNSMillis:                    view.DNSMillis,
+		ConnectMillis:                view.ConnectMillis,
+		TLSHandshakeMillis:           view.TLSHandshakeMillis,
+		RetryAfterSeconds:            view.RetryAfterSeconds,
+		RetriedAfter:                 view.RetriedAfter,
+		AutoCookies:                  view.AutoCookies,
+		SchemaErrors:                 view.SchemaErrors,
+		UpstreamStatus:               view.UpstreamStatus,
+		UpstreamTLS:                  view.UpstreamTLS,
+		TLSVerifySkipped:             view.TLSVerifySkipped,
+	}
+}
+
+type LogStore struct {
+	// TrustedProxies lists the peers whose forwarding headers are used to
+	// determine the client IP. When empty, forwarding headers are ignored.
+	TrustedProxies []*net.IPNet
+	// PathFilter, when set, limits recording to requests whose path matches.
+	PathFilter *regexp.Regexp
+	// ExcludePaths skips recording requests whose path matches any pattern.
+	ExcludePaths []*regexp.Regexp
+	// MaxTotalBodyBytes caps the combined size of stored bodies. When it is
+	// exceeded, the oldest entries lose their bodies but keep their metadata.
+	// Zero means unlimited.
+	MaxTotalBodyBytes int64
+	// BodyDir, when set, is a directory where bodies larger than
+	// BodyFileThreshold bytes are written in full, one file per body,
+	// instead of being kept in memory. Files are removed when their entry
+	// is evicted.
+	BodyDir           string
+	BodyFileThreshold int
+	// MaxAge drops unpinned entries older than this as new entries arrive.
+	// Zero keeps entries regardless of age.
+	MaxAge time.Duration
+	// OmitBodyTypes lists response content types whose bodies are replaced
+	// by a size placeholder. A trailing "/*" matches a whole top-level type.
+	OmitBodyTypes []string
+	// MaxBodyLogSize is the number of bytes of each body captured before
+	// truncating. DefaultMaxBodyLogSize is used when it is 0.
+	MaxBodyLogSize int
+	// VerbosePath selects requests whose bodies are captured up to
+	// VerboseBodyLimit instead of MaxBodyLogSize.
+	VerbosePath      *regexp.Regexp
+	VerboseBodyLimit int
+	// SessionHeader names the request header, and SessionCookie the cookie
+	// used when the header is absent, whose value becomes the entry's
+	// session ID.
+	SessionHeader string
+	SessionCookie string
+	// RawHeaderCase records request header names with the casing the
+	// client sent. It needs connections accepted by a RawHeaderListener.
+	RawHeaderCase bool
+	// Webhook, when set, receives every completed stored entry.
+	Webhook *Webhook
+	// OnEvict, when set, is called with each entry dropped to stay within
+	// the log limit. It runs without the store's lock held.
+	OnEvict func(LogEntryView)
+	// RedactBodyKeys lists lower-cased JSON keys whose values are replaced
+	// by "***" in captured JSON bodies.
+	RedactBodyKeys []string
+	// SortJSONKeys stores captured JSON bodies re-serialized with sorted
+	// keys. The bodies forwarded to the target and client are unchanged.
+	SortJSONKeys bool
+
+	mu          sync.Mutex
+	limit       int
+	nextID      int64
+	entries     []*LogEntry
+	index       map[int64]*LogEntry
+	subscribers map[chan LogEntryView]struct{}
+	// version is bumped whenever the stored entries change, for ETags.
+	version int64
+	// bodyBytes is the total size of bodies of completed, stored entries.
+	bodyBytes int64
+	// latency holds sampled request durations keyed by target host.
+	latency map[string]*latencyReservoir
+	// requestBytes and responseBytes total the body sizes of every completed
+	// exchange, including evicted and filtered ones.
+	requestBytes  int64
+	responseBytes int64
+}
+
+// LogStats summarizes the contents of a LogStore.
+type LogStats struct {
+	Entries           int          `json:"entries"`
+	BodyBytes         int64        `json:"bodyBytes"`
+	MaxTotalBodyBytes int64        `json:"maxTotalBodyBytes"`
+	RequestSizes      []SizeBucket `json:"requestSizes"`
+	ResponseSizes     []SizeBucket `json:"responseSizes"`
+	// TotalRequestBytes and TotalResponseBytes count body bytes across all
+	// exchanges since startup, not just the stored ones.
+	TotalRequestBytes  int64 `json:"totalRequestBytes"`
+	TotalResponseBytes int64 `json:"totalResponseBytes"`
+	// WebhookDropped and WebhookFailed count entries that were not
+	// delivered to the webhook because its queue was full or the POST failed.
+	WebhookDropped int64 `json:"webhookDropped,omitempty"`
+	WebhookFailed  int64 `json:"webhookFailed,omitempty"`
+	// Latency reports duration percentiles keyed by target host.
+	Latency map[string]LatencyStats `json:"latency"`
+}
+
+// LatencyStats summarizes the request durations sampled for one host.
+type LatencyStats struct {
+	Count int64 `json:"count"`
+	P50   int64 `json:"p50Millis"`
+	P90   int64 `json:"p90Millis"`
+	P99   int64 `json:"p99Millis"`
+}
+
+const (
+	// latencyReservoirSize bounds the samples kept per host.
+	latencyReservoirSize = 1024
+	// maxLatencyHosts bounds the number of hosts tracked.
+	maxLatencyHosts = 256
+)
+
+// latencyReservoir keeps a uniform random sample of durations using
+// reservoir sampling, so memory stays bounded however many are added.
+type latencyReservoir struct {
+	samples []int64
+	seen    int64
+}
+
+func (r *latencyReservoir) add(millis int64) {
+	r.seen++
+	if len(r.samples) < latencyReservoirSize {
+		r.samples = append(r.samples, millis)
+		return
+	}
+	if i := rand.Int63n(r.seen); i < latencyReservoirSize {
+		r.samples[i] = millis
+	}
+}
+
+func (r *latencyReservoir) stats() LatencyStats {
+	sorted := append([]int64(nil), r.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) int64 {
+		if len(sorted) == 0 {
+			return 0
+		}
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	return LatencyStats{Count: r.seen, P50: percentile(50), P90: percentile(90), P99: percentile(99)}
+}
+
+// SizeBucket counts the entries whose body size falls in a range.
+type SizeBucket struct {
+	Label string `json:"label"`
+	Count int    `json:"count"`
+}
+
+// sizeBucketLimits are the exclusive upper bounds of the size buckets after
+// the empty bucket; larger sizes fall in the final bucket.
+var sizeBucketLimits = []struct {
+	label string
+	limit int64
+}{
+	{"<1KB", 1 << 10},
+	{"<10KB", 10 << 10},
+	{"<100KB", 100 << 10},
+	{"<1MB", 1 << 20},
+}
+
+func newSizeHistogram() []SizeBucket {
+	buckets := []SizeBucket{{Label: "0"}}
+	for _, bucket := range sizeBucketLimits {
+		buckets = append(buckets, SizeBucket{Label: bucket.label})
+	}
+	return append(buckets, SizeBucket{Label: ">=1MB"})
+}
+
+// addToSizeHistogram counts size in the matching bucket of buckets.
+func addToSizeHistogram(buckets []SizeBucket, size int64) {
+	if size <= 0 {
+		buckets[0].Count++
+		return
+	}
+	for i, bucket := range sizeBucketLimits {
+		if size < bucket.limit {
+			buckets[i+1].Count++
+			return
+		}
+	}
+	buckets[len(buckets)-1].Count++
+}
+
+// subscriberBuffer bounds how many completed entries may be queued for a
+// single subscriber. Entries are dropped for subscribers that fall behind.
+const subscriberBuffer = 64
+
+// LogStoreOption configures a LogStore built by NewLogStore.
+type LogStoreOption func(*LogStore)
+
+// WithLimit sets the number of entries kept. Values below 1 keep
+// DefaultLogLimit.
+func WithLimit(limit int) LogStoreOption {
+	return func(s *LogStore) {
+		if limit > 0 {
+			s.limit = limit
+		}
+	}
+}
+
+// WithMaxAge sets LogStore.MaxAge.
+func WithMaxAge(maxAge time.Duration) LogStoreOption {
+	return func(s *LogStore) {
+		s.MaxAge = maxAge
+	}
+}
+
+// WithMaxBodyBytes sets LogStore.MaxTotalBodyBytes.
+func WithMaxBodyBytes(maxBytes int64) LogStoreOption {
+	return func(s *LogStore) {
+		s.MaxTotalBodyBytes = maxBytes
+	}
+}
+
+// NewLogStore returns an empty LogStore keeping up to DefaultLogLimit
+// entries, as adjusted by opts.
+func NewLogStore(opts ...LogStoreOption) *LogStore {
+	s := &LogStore{
+		limit:       DefaultLogLimit,
+		index:       make(map[int64]*LogEntry),
+		subscribers: make(map[chan LogEntryView]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// sessionID returns the session r belongs to, or "" if it carries none.
+func (s *LogStore) sessionID(r *http.Request) string {
+	if s.SessionHeader != "" {
+		if id := r.Header.Get(s.SessionHeader); id != "" {
+			return id
+		}
+	}
+	if s.SessionCookie != "" {
+		if cookie, err := r.Cookie(s.SessionCookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// SessionSummary describes the stored entries of one session.
+type SessionSummary struct {
+	ID        string    `json:"id"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// Sessions summarizes the sessions of the stored entries, most recently
+// active first.
+func (s *LogStore) Sessions() []SessionSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byID := make(map[string]*SessionSummary)
+	var sessions []*SessionSummary
+	for _, entry := range s.entries {
+		if entry.SessionID == "" {
+			continue
+		}
+		summary, ok := byID[entry.SessionID]
+		if !ok {
+			summary = &SessionSummary{ID: entry.SessionID, FirstSeen: entry.StartedAt}
+			byID[entry.SessionID] = summary
+			sessions = append(sessions, summary)
+		}
+		summary.Count++
+		if entry.StartedAt.Before(summary.FirstSeen) {
+			summary.FirstSeen = entry.StartedAt
+		}
+		if entry.StartedAt.After(summary.LastSeen) {
+			summary.LastSeen = entry.StartedAt
+		}
+	}
+	result := make([]SessionSummary, 0, len(sessions))
+	for _, summary := range sessions {
+		result = append(result, *summary)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].LastSeen.After(result[j].LastSeen)
+	})
+	return result
+}
+
+// SessionEntries returns the stored entries of session id, newest first.
+func (s *LogStore) SessionEntries(id string) []LogEntryView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []LogEntryView
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if s.entries[i].SessionID == id {
+			result = append(result, s.entries[i].Snapshot())
+		}
+	}
+	return result
+}
+
+// RecentErrors returns up to limit failed entries, newest first.
+func (s *LogStore) RecentErrors(limit int) []LogEntryView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []LogEntryView{}
+	for i := len(s.entries) - 1; i >= 0 && len(result) < limit; i-- {
+		if s.entries[i].Failed() {
+			result = append(result, s.entries[i].Snapshot())
+		}
+	}
+	return result
+}
+
+// NewEntry starts a log entry for r. Requests that are filtered out of the
+// log get a detached entry with a zero ID that is never stored.
+func (s *LogStore) NewEntry(r *http.Request) *LogEntry {
+	entry := &LogEntry{
+		StartedAt:           time.Now(),
+		ClientIP:            clientIP(r, s.TrustedProxies),
+		SessionID:           s.sessionID(r),
+		Method:              r.Method,
+		URL:                 r.URL.String(),
+		Proto:               r.Proto,
+		RequestURI:          r.RequestURI,
+		RequestHeaders:      flattenHeaders(r.Header),
+		RequestHeaderValues: multiValueHeaders(r.Header),
+		omitBodyTypes:       s.OmitBodyTypes,
+		redactBodyKeys:      s.RedactBodyKeys,
+		sortJSONKeys:        s.SortJSONKeys,
+		bodyLimit:           s.MaxBodyLogSize,
+		bodyDir:             s.BodyDir,
+		bodyFileThreshold:   s.BodyFileThreshold,
+	}
+	dropTargetSignature(entry.RequestHeaders, entry.RequestHeaderValues)
+	if s.RawHeaderCase {
+		if names := rawHeaderNames(r); names != nil {
+			respellHeaders(entry.RequestHeaders, names)
+			respellHeaders(entry.RequestHeaderValues, names)
+		}
+	}
+	if s.VerbosePath != nil && s.VerbosePath.MatchString(r.URL.Path) {
+		entry.bodyLimit = max(s.VerboseBodyLimit, entry.captureLimit())
+	}
+	if !s.shouldRecord(r.URL.Path) {
+		return entry
+	}
+
+	var evicted []*LogEntry
+	defer func() { s.notifyEvicted(evicted) }()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	entry.ID = s.nextID
+	s.version++
+	s.entries = append(s.entries, entry)
+	s.index[entry.ID] = entry
+
+	if len(s.entries) > s.limit {
+		evicted = append(evicted, s.evictOldest())
+	}
+	if s.MaxAge > 0 {
+		evicted = append(evicted, s.evictExpired(entry.StartedAt.Add(-s.MaxAge))...)
+	}
+
+	return entry
+}
+
+// evictOldest drops and returns the oldest unpinned entry. If every entry is
+// pinned, the oldest entry is dropped anyway so the limit stays a hard
+// maximum.
+func (s *LogStore) evictOldest() *LogEntry {
+	victim := 0
+	for i, entry := range s.entries {
+		if !entry.IsPinned() {
+			victim = i
+			break
+		}
+	}
+	evicted := s.entries[victim]
+	s.bodyBytes -= evicted.accountedBytes
+	delete(s.index, evicted.ID)
+	s.entries = append(s.entries[:victim], s.entries[victim+1:]...)
+	return evicted
+}
+
+// evictExpired drops and returns the unpinned entries that started before
+// cutoff.
+func (s *LogStore) evictExpired(cutoff time.Time) []*LogEntry {
+	var expired []*LogEntry
+	kept := s.entries[:0]
+	for _, entry := range s.entries {
+		if entry.StartedAt.Before(cutoff) && !entry.IsPinned() {
+			s.bodyBytes -= entry.accountedBytes
+			delete(s.index, entry.ID)
+			expired = append(expired, entry)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	clear(s.entries[len(kept):])
+	s.entries = kept
+	return expired
+}
+
+// notifyEvicted passes evicted entries to OnEvict. It must be called
+// without s.mu held.
+func (s *LogStore) notifyEvicted(evicted []*LogEntry) {
+	for _, entry := range evicted {
+		// The hook runs first so that it can still read any body files.
+		if s.OnEvict != nil {
+			s.OnEvict(entry.Snapshot())
+		}
+		entry.removeBodyFiles()
+	}
+}
+
+// LogEviction is an OnEvict hook that logs a summary of the dropped entry.
+func LogEviction(view LogEntryView) {
+	log.Printf("evicted entry %d: %s %s %d", view.ID, view.Method, view.URL, view.Status)
+}
+
+// enforceBodyBudget drops bodies from the oldest unpinned entries until the
+// total stored body size fits within MaxTotalBodyBytes.
+func (s *LogStore) enforceBodyBudget() {
+	if s.MaxTotalBodyBytes <= 0 {
+		return
+	}
+	for _, entry := range s.entries {
+		if s.bodyBytes <= s.MaxTotalBodyBytes {
+			return
+		}
+		if entry.accountedBytes == 0 || entry.IsPinned() {
+			continue
+		}
+		entry.dropBodies()
+		s.bodyBytes -= entry.accountedBytes
+		entry.accountedBytes = 0
+	}
+}
+
+func (s *LogStore) shouldRecord(path string) bool {
+	if s.PathFilter != nil && !s.PathFilter.MatchString(path) {
+		return false
+	}
+	for _, pattern := range s.ExcludePaths {
+		if pattern.MatchString(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// Complete marks entry as finished and notifies subscribers.
+func (s *LogStore) Complete(entry *LogEntry) {
+	view := entry.Snapshot()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordLatency(view.Target, view.DurationMillis)
+	s.requestBytes += max(view.RequestContentLength, 0)
+	s.responseBytes += max(view.ResponseContentLength, 0)
+	if _, stored := s.index[entry.ID]; !stored {
+		// The entry was evicted while in flight, after which no one
+		// removes the body files it went on to write.
+		entry.removeBodyFiles()
+		return
+	}
+	s.version++
+	entry.accountedBytes = entry.bodySize()
+	s.bodyBytes += entry.accountedBytes
+	s.enforceBodyBudget()
+	s.broadcast(view)
+	if s.Webhook != nil {
+		s.Webhook.Enqueue(view)
+	}
+}
+
+// recordLatency samples the duration of a request to target. It is called
+// for every request, including ones filtered out of the log.
+func (s *LogStore) recordLatency(target string, millis int64) {
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Host == "" {
+		return
+	}
+	reservoir, ok := s.latency[parsed.Host]
+	if !ok {
+		if len(s.latency) >= maxLatencyHosts {
+			return
+		}
+		if s.latency == nil {
+			s.latency = make(map[string]*latencyReservoir)
+		}
+		reservoir = &latencyReservoir{}
+		s.latency[parsed.Host] = reservoir
+	}
+	reservoir.add(millis)
+}
+
+const (
+	// webhookQueueSize bounds the entries waiting to be posted.
+	webhookQueueSize = 256
+	webhookTimeout   = 10 * time.Second
+)
+
+// Webhook posts completed entries as JSON to a URL from a single background
+// worker, so a slow receiver never blocks proxying. Entries that arrive
+// while the queue is full are dropped and counted.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+
+	queue   chan LogEntryView
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// NewWebhook returns a Webhook for url and starts its worker. Its client
+// connects to url directly, ignoring HTTP_PROXY and HTTPS_PROXY, so that
+// posts cannot pass back through this proxy and be logged and posted again.
+func NewWebhook(url string) *Webhook {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	w := &Webhook{
+		URL:    url,
+		Client: &http.Client{Transport: transport, Timeout: webhookTimeout},
+		queue:  make(chan LogEntryView, webhookQueueSize),
+	}
+	go w.run()
+	return w
+}
+
+// Enqueue schedules view for delivery without blocking.
+func (w *Webhook) Enqueue(view LogEntryView) {
+	select {
+	case w.queue <- view:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+func (w *Webhook) run() {
+	for view := range w.queue {
+		if err := w.post(view); err != nil {
+			w.failed.Add(1)
+			log.Printf("webhook: %v", err)
+		}
+	}
+}
+
+func (w *Webhook) post(view LogEntryView) error {
+	body, err := json.Marshal(view)
+	if err != nil {
+		return err
+	}
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// broadcast sends view to every subscriber that has room for it.
+func (s *LogStore) broadcast(view LogEntryView) {
+	for ch := range s.subscribers {
+		select {
+		case ch <- view:
+		default:
+		}
+	}
+}
+
+// Import adds previously exported entries to the store in chronological
+// order. They are assigned fresh IDs and are subject to the usual entry
+// limit and body budget.
+func (s *LogStore) Import(views []LogEntryView) int {
+	sort.SliceStable(views, func(i, j int) bool {
+		return views[i].StartedAt.Before(views[j].StartedAt)
+	})
+
+	var evicted []*LogEntry
+	defer func() { s.notifyEvicted(evicted) }()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	imported := make([]*LogEntry, 0, len(views))
+	for _, view := range views {
+		entry := newEntryFromView(view)
+		s.nextID++
+		entry.ID = s.nextID
+		entry.accountedBytes = entry.bodySize()
+		s.bodyBytes += entry.accountedBytes
+		// Entries are kept in the order they started, so that the oldest
+		// are evicted first.
+		i := sort.Search(len(s.entries), func(i int) bool {
+			return s.entries[i].StartedAt.After(entry.StartedAt)
+		})
+		s.entries = slices.Insert(s.entries, i, entry)
+		s.index[entry.ID] = entry
+		imported = append(imported, entry)
+		if len(s.entries) > s.limit {
+			evicted = append(evicted, s.evictOldest())
+		}
+	}
+	s.version++
+	s.enforceBodyBudget()
+	for _, entry := range imported {
+		if _, stored := s.index[entry.ID]; stored {
+			s.broadcast(entry.Snapshot())
+		}
+	}
+	return len(views)
+}
+
+// Discard removes entry from the store without notifying subscribers.
+func (s *LogStore) Discard(entry *LogEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, stored := s.index[entry.ID]; !stored {
+		return
+	}
+	delete(s.index, entry.ID)
+	for i, candidate := range s.entries {
+		if candidate == entry {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			break
+		}
+	}
+	s.bodyBytes -= entry.accountedBytes
+	s.version++
+}
+
+// Subscribe returns a channel that receives every completed entry, and a
+// function that must be called to stop receiving.
+func (s *LogStore) Subscribe() (<-chan LogEntryView, func()) {
+	ch := make(chan LogEntryView, subscriberBuffer)
+
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}
+}
+
+func (s *LogStore) Stats() LogStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := LogStats{
+		Entries:            len(s.entries),
+		BodyBytes:          s.bodyBytes,
+		MaxTotalBodyBytes:  s.MaxTotalBodyBytes,
+		RequestSizes:       newSizeHistogram(),
+		ResponseSizes:      newSizeHistogram(),
+		TotalRequestBytes:  s.requestBytes,
+		TotalResponseBytes: s.responseBytes,
+		Latency:            make(map[string]LatencyStats, len(s.latency)),
+	}
+	for host, reservoir := range s.latency {
+		stats.Latency[host] = reservoir.stats()
+	}
+	if s.Webhook != nil {
+		stats.WebhookDropped = s.Webhook.dropped.Load()
+		stats.WebhookFailed = s.Webhook.failed.Load()
+	}
+	for _, entry := range s.entries {
+		entry.mu.Lock()
+		addToSizeHistogram(stats.RequestSizes, entry.RequestContentLength)
+		addToSizeHistogram(stats.ResponseSizes, entry.ResponseContentLength)
+		entry.mu.Unlock()
+	}
+	return stats
+}
+
+// Usage returns the number of stored entries and the size of their bodies.
+// Unlike Stats, it doesn't visit every entry.
+func (s *LogStore) Usage() (entries int, bodyBytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries), s.bodyBytes
+}
+
+// ETag returns an entity tag that changes whenever the stored entries do.
+func (s *LogStore) ETag() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf(`"%d-%d"`, s.nextID, s.version)
+}
+
+func (s *LogStore) List() []LogEntryView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]LogEntryView, 0, len(s.entries))
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		result = append(result, s.entries[i].Snapshot())
+	}
+	return result
+}
+
+// SetNote attaches an annotation to the entry with the given id.
+func (s *LogStore) SetNote(id int64, note string) (LogEntryView, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.index[id]
+	if !ok {
+		return LogEntryView{}, false
+	}
+	entry.SetNote(note)
+	s.version++
+	return entry.Snapshot(), true
+}
+
+// SetPinned pins or unpins the entry with the given id. Pinned entries are
+// skipped by count-based eviction.
+func (s *LogStore) SetPinned(id int64, pinned bool) (LogEntryView, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.index[id]
+	if !ok {
+		return LogEntryView{}, false
+	}
+	entry.SetPinned(pinned)
+	s.version++
+	return entry.Snapshot(), true
+}
+
+func (s *LogStore) Get(id int64) (LogEntryView, bool) {
+	s.mu.Lock()
+	entry, ok := s.index[id]
+	s.mu.Unlock()
+	if !ok {
+		return LogEntryView{}, false
+	}
+	return entry.Snapshot(), true
+}
+
+func handleListLogs(store *LogStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		etag := store.ETag()
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		entries := store.List()
+		if key := r.URL.Query().Get("sort"); key != "" {
+			if !sortLogEntries(entries, key) {
+				http.Error(w, fmt.Sprintf("invalid sort %q", key), http.StatusBadRequest)
+				return
+			}
+		}
+		respondJSON(w, r, entries)
+	}
+}
+
+// logSortKeys extract the value entries are ordered by for each sort key.
+var logSortKeys = map[string]func(LogEntryView) int64{
+	"duration": func(e LogEntryView) int64 { return e.DurationMillis },
+	"size":     func(e LogEntryView) int64 { return e.RequestContentLength + e.ResponseContentLength },
+	"status":   func(e LogEntryView) int64 { return int64(e.Status) },
+	"time":     func(e LogEntryView) int64 { return e.StartedAt.UnixNano() },
+}
+
+// sortLogEntries orders entries by key, ascending, or descending when key
+// starts with "-". Ties keep their existing order. It reports false for an
+// unknown key.
+func sortLogEntries(entries []LogEntryView, key string) bool {
+	name, descending := strings.CutPrefix(key, "-")
+	value, ok := logSortKeys[name]
+	if !ok {
+		return false
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if descending {
+			return value(entries[i]) > value(entries[j])
+		}
+		return value(entries[i]) < value(entries[j])
+	})
+	return true
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+const postmanSchema = "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"
+
+type postmanCollection struct {
+	Info postmanInfo   `json:"info"`
+	Item []postmanItem `json:"item"`
+}
+
+type postmanInfo struct {
+	Name   string `json:"name"`
+	Schema string `json:"schema"`
+}
+
+type postmanItem struct {
+	Name    string          `json:"name"`
+	Item    []postmanItem   `json:"item,omitempty"`
+	Request *postmanRequest `json:"request,omitempty"`
+}
+
+type postmanRequest struct {
+	Method      string          `json:"method"`
+	Header      []postmanHeader `json:"header"`
+	URL         string          `json:"url"`
+	Body        *postmanBody    `json:"body,omitempty"`
+	Description string          `json:"description,omitempty"`
+}
+
+type postmanHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type postmanBody struct {
+	Mode string `json:"mode"`
+	Raw  string `json:"raw"`
+}
+
+// maxImportSize bounds the size of an uploaded capture.
+const maxImportSize = 256 << 20
+
+// handleImportLogs loads a capture produced by /api/logs/export.
+func handleImportLogs(store *LogStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodPost) {
+			return
+		}
+		var views []LogEntryView
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize)).Decode(&views); err != nil {
+			http.Error(w, fmt.Sprintf("invalid capture: %v", err), http.StatusBadRequest)
+			return
+		}
+		respondJSON(w, r, map[string]int{"imported": store.Import(views)})
+	}
+}
+
+// handleExportLogs downloads every stored entry as a JSON array. Entries are
+// encoded one at a time so the whole document is never buffered.
+func handleExportLogs(store *LogStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=logs.json")
+		encoder := json.NewEncoder(w)
+		_, _ = io.WriteString(w, "[")
+		for i, entry := range store.List() {
+			if i > 0 {
+				_, _ = io.WriteString(w, ",")
+			}
+			if err := encoder.Encode(entry); err != nil {
+				return
+			}
+		}
+		_, _ = io.WriteString(w, "]\n")
+	}
+}
+
+func handlePostmanExport(store *LogStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", "attachment; filename=proxymystuff.postman_collection.json")
+		respondJSON(w, r, buildPostmanCollection(store.List(), store.BodyDir))
+	}
+}
+
+// buildPostmanCollection converts entries (newest first, as returned by
+// List) into a Postman collection with one folder per target host. Bodies
+// stored in files are read from bodyDir. A request whose captured body is
+// incomplete is exported without it, with a description saying why.
+func buildPostmanCollection(entries []LogEntryView, bodyDir string) postmanCollection {
+	var folders []postmanItem
+	folderIndex := make(map[string]int)
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		requestURL := entry.UpstreamURL
+		if requestURL == "" {
+			requestURL = entry.URL
+		}
+
+		host := "unresolved"
+		if parsed, err := url.Parse(requestURL); err == nil && parsed.Host != "" {
+			host = parsed.Host
+		}
+
+		request := &postmanRequest{Method: entry.Method, URL: requestURL, Header: []postmanHeader{}}
+		keys := make([]string, 0, len(entry.RequestHeaders))
+		for key := range entry.RequestHeaders {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			// Names are kept as sent with -raw-header-case.
+			if isProxyControlHeader(key) || http.CanonicalHeaderKey(key) == "Content-Length" {
+				continue
+			}
+			for _, value := range requestHeaderValues(entry, key) {
+				request.Header = append(request.Header, postmanHeader{Key: key, Value: value})
+			}
+		}
+		body, err := storedRequestBody(entry, bodyDir)
+		switch {
+		case err != nil:
+			request.Description = "The captured request body is not included: " + err.Error() + "."
+		case len(body) > 0 && utf8.Valid(body):
+			request.Body = &postmanBody{Mode: "raw", Raw: string(body)}
+		}
+
+		idx, ok := folderIndex[host]
+		if !ok {
+			idx = len(folders)
+			folderIndex[host] = idx
+			folders = append(folders, postmanItem{Name: host})
+		}
+		folders[idx].Item = append(folders[idx].Item, postmanItem{
+			Name:    fmt.Sprintf("%s %s", entry.Method, requestURL),
+			Request: request,
+		})
+	}
+
+	return postmanCollection{
+		Info: postmanInfo{Name: "Proxymystuff capture", Schema: postmanSchema},
+		Item: folders,
+	}
+}
+
+// RuntimeConfig is the non-secret configuration reported by /api/config.
+type RuntimeConfig struct {
+	ListenAddr    string `json:"listenAddr"`
+	DefaultTarget string `json:"defaultTarget,omitempty"`
+	UpstreamProxy string `json:"upstreamProxy,omitempty"`
+	LogLimit      int    `json:"logLimit"`
+	// MaxBodyLogSize is filled in from the LogStore.
+	MaxBodyLogSize    int            `json:"maxBodyLogSize"`
+	MaxTotalBodyBytes int64          `json:"maxTotalBodyBytes"`
+	MaxRequestSize    int64          `json:"maxRequestSize"`
+	SampleRate        float64        `json:"sampleRate"`
+	Retries           int            `json:"retries"`
+	AllowedMethods    []string       `json:"allowedMethods,omitempty"`
+	LogFormat         string         `json:"logFormat"`
+	Features          ConfigFeatures `json:"features"`
+}
+
+// ConfigFeatures reports which optional features are enabled.
+type ConfigFeatures struct {
+	MethodAllowlist  bool `json:"methodAllowlist"`
+	LogFilter        bool `json:"logFilter"`
+	ResponseRewrite  bool `json:"responseRewrite"`
+	RewriteRedirects bool `json:"rewriteRedirects"`
+	RewriteCookies   bool `json:"rewriteCookies"`
+	Coalesce         bool `json:"coalesce"`
+	Sampling         bool `json:"sampling"`
+	CircuitBreaker   bool `json:"circuitBreaker"`
+	MaxConcurrency   bool `json:"maxConcurrency"`
+	NormalizePath    bool `json:"normalizePath"`
+	Delays           bool `json:"delays"`
+	Cassette         bool `json:"cassette"`
+	BodyDir          bool `json:"bodyDir"`
+	Breakpoints      bool `json:"breakpoints"`
+	CORS             bool `json:"cors"`
+	HostRoutes       bool `json:"hostRoutes"`
+	OmitBinary       bool `json:"omitBinary"`
+	Mocks            bool `json:"mocks"`
+	Throttle         bool `json:"throttle"`
+	CookieJar        bool `json:"cookieJar"`
+	Cache            bool `json:"cache"`
+	HTTPCache        bool `json:"httpCache"`
+	Schemas          bool `json:"schemas"`
+	TargetSignatures bool `json:"targetSignatures"`
+	RedactBodyKeys   bool `json:"redactBodyKeys"`
+	SortJSONKeys     bool `json:"sortJsonKeys"`
+	CaptureTLS       bool `json:"captureTls"`
+	Insecure         bool `json:"insecure"`
+	ClientCert       bool `json:"clientCert"`
+	ForceStatus      bool `json:"forceStatus"`
+	RequestPatches   bool `json:"requestPatches"`
+	Webhook          bool `json:"webhook"`
+	TargetHeaders    bool `json:"targetHeaders"`
+	RawHeaderCase    bool `json:"rawHeaderCase"`
+	DetectLoops      bool `json:"detectLoops"`
+}
+
+// handlePause pauses or resumes proxy and reports the resulting state.
+func handlePause(proxy *ProxyHandler, paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodPost) {
+			return
+		}
+		proxy.SetPaused(paused)
+		respondJSON(w, r, map[string]bool{"paused": proxy.Paused()})
+	}
+}
+
+// handleConfig reports config, with the body capture limit read from store.
+func handleConfig(config RuntimeConfig, store *LogStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config.MaxBodyLogSize = store.captureLimit()
+		respondJSON(w, r, config)
+	}
+}
+
+func handleListSessions(store *LogStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, r, store.Sessions())
+	}
+}
+
+func handleGetSession(store *LogStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/sessions/")
+		entries := store.SessionEntries(id)
+		if id == "" || len(entries) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		respondJSON(w, r, entries)
+	}
+}
+
+// handleListBreakpoints lists the requests held at proxy's breakpoints.
+func handleListBreakpoints(proxy *ProxyHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, r, proxy.Breakpoints.Paused())
+	}
+}
+
+// handleContinueBreakpoint releases a held request, applying the optional
+// BreakpointEdit in the request body.
+func handleContinueBreakpoint(proxy *ProxyHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idStr, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/breakpoints/"), "/")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil || action != "continue" {
+			http.NotFound(w, r)
+			return
+		}
+		if !requireMethod(w, r, http.MethodPost) {
+			return
+		}
+		var edit BreakpointEdit
+		if err := json.NewDecoder(r.Body).Decode(&edit); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "invalid breakpoint edit", http.StatusBadRequest)
+			return
+		}
+		if !proxy.Breakpoints.Continue(id, edit) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// defaultErrorsLimit is the number of entries /api/errors returns when no
+// limit is given.
+const defaultErrorsLimit = 20
+
+// handleRecentErrors lists the most recent failed entries, newest first.
+func handleRecentErrors(store *LogStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultErrorsLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+		respondJSON(w, r, store.RecentErrors(limit))
+	}
+}
+
+// DebugInfo is the runtime snapshot reported by /api/debug.
+type DebugInfo struct {
+	Goroutines     int    `json:"goroutines"`
+	HeapAllocBytes uint64 `json:"heapAllocBytes"`
+	HeapObjects    uint64 `json:"heapObjects"`
+	SysBytes       uint64 `json:"sysBytes"`
+	NumGC          uint32 `json:"numGc"`
+	Entries        int    `json:"entries"`
+	// BodyBytes approximates the memory held by stored bodies.
+	BodyBytes int64 `json:"bodyBytes"`
+}
+
+func handleDebug(store *LogStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		info := DebugInfo{
+			Goroutines:     runtime.NumGoroutine(),
+			HeapAllocBytes: mem.HeapAlloc,
+			HeapObjects:    mem.HeapObjects,
+			SysBytes:       mem.Sys,
+			NumGC:          mem.NumGC,
+		}
+		info.Entries, info.BodyBytes = store.Usage()
+		respondJSON(w, r, info)
+	}
+}
+
+func handleStats(store *LogStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, r, store.Stats())
+	}
+}
+
+func handleGetLog(store *LogStore, replayer *Replayer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idStr, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/logs/"), "/")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid log id", http.StatusBadRequest)
+			return
+		}
+		entry, ok := store.Get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch action {
+		case "":
+			respondJSON(w, r, entry)
+		case "note":
+			if !requireMethod(w, r, http.MethodPut) {
+				return
+			}
+			var payload struct {
+				Note string `json:"note"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid note payload", http.StatusBadRequest)
+				return
+			}
+			updated, ok := store.SetNote(id, payload.Note)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			respondJSON(w, r, updated)
+		case "pin":
+			if !requireMethod(w, r, http.MethodPost, http.MethodDelete) {
+				return
+			}
+			updated, ok := store.SetPinned(id, r.Method == http.MethodPost)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			respondJSON(w, r, updated)
+		case "curl":
+			curl, err := formatCurlCommand(entry, store.BodyDir)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write([]byte(curl))
+		case "replay":
+			if !requireMethod(w, r, http.MethodPost) {
+				return
+			}
+			result, err := replayer.Replay(r.Context(), entry)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			respondJSON(w, r, result)
+		case "jsonpath":
+			segments, err := parseJSONPath(r.URL.Query().Get("expr"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid expression: %v", err), http.StatusBadRequest)
+				return
+			}
+			body, err := decodeStoredBody(entry.ResponseBody, entry.ResponseBodyEncoding)
+			if err != nil {
+				http.Error(w, "response body is not JSON", http.StatusBadRequest)
+				return
+			}
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.UseNumber()
+			var document any
+			if err := decoder.Decode(&document); err != nil {
+				http.Error(w, "response body is not JSON", http.StatusBadRequest)
+				return
+			}
+			result, ok := evaluateJSONPath(document, segments)
+			if !ok {
+				http.Error(w, "no match", http.StatusNotFound)
+				return
+			}
+			respondJSON(w, r, result)
+		case "download":
+			serveStoredBody(w, r, entry, store.BodyDir)
+		case "http":
+			message, err := formatRawHTTPRequest(entry, store.BodyDir)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "message/http")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=request-%d.http", entry.ID))
+			_, _ = w.Write(message)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// jsonPathSegment is one step of a JSONPath expression: a member name, an
+// array index, or a wildcard.
+type jsonPathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses the subset of JSONPath made of $, .name, ['name'],
+// [n] and the * wildcard.
+func parseJSONPath(expr string) ([]jsonPathSegment, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(expr), "$")
+	if !ok {
+		return nil, errors.New("expression must start with $")
+	}
+	var segments []jsonPathSegment
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			return nil, errors.New("recursive descent is not supported")
+		case rest[0] == '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			if name == "" {
+				return nil, errors.New("empty member name")
+			}
+			segments = append(segments, jsonPathSegment{key: name, wildcard: name == "*"})
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [")
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			if inner == "*" {
+				segments = append(segments, jsonPathSegment{wildcard: true})
+			} else if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				segments = append(segments, jsonPathSegment{key: inner[1 : len(inner)-1]})
+			} else if index, err := strconv.Atoi(inner); err == nil {
+				segments = append(segments, jsonPathSegment{index: index, isIndex: true})
+			} else {
+				return nil, fmt.Errorf("unsupported selector [%s]", inner)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+	}
+	return segments, nil
+}
+
+// evaluateJSONPath applies segments to document. Expressions containing a
+// wildcard yield an array of every match; others yield the single matching
+// value, or false if there is none.
+func evaluateJSONPath(document any, segments []jsonPathSegment) (any, bool) {
+	nodes := []any{document}
+	multiple := false
+	for _, segment := range segments {
+		var next []any
+		for _, node := range nodes {
+			switch value := node.(type) {
+			case map[string]any:
+				if segment.wildcard {
+					keys := make([]string, 0, len(value))
+					for key := range value {
+						keys = append(keys, key)
+					}
+					sort.Strings(keys)
+					for _, key := range keys {
+						next = append(next, value[key])
+					}
+				} else if member, ok := value[segment.key]; ok && !segment.isIndex {
+					next = append(next, member)
+				}
+			case []any:
+				if segment.wildcard {
+					next = append(next, value...)
+				} else if segment.isIndex {
+					index := segment.index
+					if index < 0 {
+						index += len(value)
+					}
+					if index >= 0 && index < len(value) {
+						next = append(next, value[index])
+					}
+				}
+			}
+		}
+		multiple = multiple || segment.wildcard
+		nodes = next
+	}
+	if multiple {
+		if nodes == nil {
+			nodes = []any{}
+		}
+		return nodes, true
+	}
+	if len(nodes) == 0 {
+		return nil, false
+	}
+	return nodes[0], true
+}
+
+// SchemaRule validates JSON responses for request paths matching Pattern.
+type SchemaRule struct {
+	Pattern *regexp.Regexp
+	Schema  *JSONSchema
+}
+
+// JSONSchema is the subset of JSON Schema used to validate responses: type,
+// enum, properties, required, additionalProperties (as a boolean) and
+// items. Other keywords are ignored.
+type JSONSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Properties           map[string]*JSONSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties any                    `json:"additionalProperties"`
+	Items                *JSONSchema            `json:"items"`
+}
+
+// schemaTypes holds a schema's "type", which may be a string or an array.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+// ParseSchemaRule parses a pattern=file value and loads the schema file.
+func ParseSchemaRule(value string) (SchemaRule, error) {
+	pattern, path, ok := strings.Cut(value, "=")
+	if !ok || pattern == "" || path == "" {
+		return SchemaRule{}, fmt.Errorf("expected pattern=file, got %q", value)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return SchemaRule{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SchemaRule{}, err
+	}
+	var schema JSONSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return SchemaRule{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return SchemaRule{Pattern: re, Schema: &schema}, nil
+}
+
+// schemaFor returns the schema of the first rule matching path, or nil.
+func (h *ProxyHandler) schemaFor(path string) *JSONSchema {
+	for _, rule := range h.Schemas {
+		if rule.Pattern.MatchString(path) {
+			return rule.Schema
+		}
+	}
+	return nil
+}
+
+// validateResponseSchema checks the JSON body of a successful response
+// against schema. Error responses, empty bodies such as those of HEAD
+// requests and 204 and 304 responses, and other content types are not
+// validated.
+func validateResponseSchema(status int, headers http.Header, body []byte, schema *JSONSchema) []string {
+	if status < 200 || status > 299 || len(body) == 0 || bodyLanguage(headers.Get("Content-Type"), "") != "json" {
+		return nil
+	}
+	decoded, _ := decodeResponseBody(headers, body)
+	var document any
+	if err := json.Unmarshal(decoded, &document); err != nil {
+		return []string{fmt.Sprintf("$: invalid JSON: %v", err)}
+	}
+	var errs []string
+	schema.validate(document, "$", &errs)
+	return errs
+}
+
+// validate appends a message to errs for each way value violates s. Paths
+// use the same notation as the jsonpath endpoint.
+func (s *JSONSchema) validate(value any, path string, errs *[]string) {
+	if len(s.Type) > 0 && !slices.ContainsFunc(s.Type, func(name string) bool { return schemaTypeMatches(name, value) }) {
+		*errs = append(*errs, fmt.Sprintf("%s: expected %s, got %s", path, strings.Join(s.Type, " or "), jsonTypeName(value)))
+		return
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(allowed any) bool { return reflect.DeepEqual(allowed, value) }) {
+		*errs = append(*errs, fmt.Sprintf("%s: value not in enum", path))
+	}
+	switch value := value.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := value[name]; !ok {
+				*errs = append(*errs, fmt.Sprintf("%s: missing required property %q", path, name))
+			}
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if property, ok := s.Properties[key]; ok {
+				property.validate(value[key], fmt.Sprintf("%s.%s", path, key), errs)
+			} else if s.AdditionalProperties == false {
+				*errs = append(*errs, fmt.Sprintf("%s: unexpected property %q", path, key))
+			}
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range value {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	}
+}
+
+func schemaTypeMatches(name string, value any) bool {
+	if name == "integer" {
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	}
+	return name == jsonTypeName(value)
+}
+
+// jsonTypeName returns the JSON Schema type name of a decoded JSON value.
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// formatRawHTTPRequest renders the captured request as a raw HTTP message
+// (request line, headers, blank line, body) for use with REST client tools.
+// The request is addressed to the target it was sent to, which is named in
+// a Host header. A body stored in a file is read from bodyDir.
+func formatRawHTTPRequest(entry LogEntryView, bodyDir string) ([]byte, error) {
+	body, err := storedRequestBody(entry, bodyDir)
+	if err != nil {
+		return nil, err
+	}
+	requestURI, host := entry.URL, ""
+	if upstream, err := url.Parse(entry.UpstreamURL); err == nil && upstream.Host != "" {
+		requestURI, host = upstream.RequestURI(), upstream.Host
+	} else if inbound, err := url.Parse(entry.URL); err == nil && inbound.Host != "" {
+		requestURI, host = inbound.RequestURI(), inbound.Host
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", entry.Method, requestURI)
+	if host != "" {
+		fmt.Fprintf(&buf, "Host: %s\r\n", host)
+	}
+
+	keys := make([]string, 0, len(entry.RequestHeaders))
+	for key := range entry.RequestHeaders {
+		if host != "" && http.CanonicalHeaderKey(key) == "Host" || isProxyControlHeader(key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range requestHeaderValues(entry, key) {
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// isProxyControlHeader reports whether key names a header that addresses
+// the proxy rather than the target. Names may be in their raw case.
+func isProxyControlHeader(key string) bool {
+	canonical := http.CanonicalHeaderKey(key)
+	return canonical == "X-Proxy-Target" || canonical == "X-Proxy-Target-Signature"
+}
+
+// replayHeaderExclusions lists captured request headers that are not sent
+// when a request is reconstructed.
+var replayHeaderExclusions = map[string]bool{
+	"X-Proxy-Target":           true,
+	"X-Proxy-Target-Signature": true,
+	"Content-Length":           true,
+	"Connection":               true,
+}
+
+// sortedReplayHeaders returns the captured header names to reconstruct, in
+// a stable order.
+func sortedReplayHeaders(headers map[string]string) []string {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		if !replayHeaderExclusions[http.CanonicalHeaderKey(key)] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func replayURL(entry LogEntryView) (string, error) {
+	if entry.UpstreamURL == "" {
+		return "", errors.New("entry has no resolved upstream URL")
+	}
+	return entry.UpstreamURL, nil
+}
+
+// formatCurlCommand renders the captured request as a curl command line.
+// The method is always passed verbatim with -X so that PATCH and
+// non-standard methods survive. A body stored in a file in bodyDir is
+// passed to curl by path.
+func formatCurlCommand(entry LogEntryView, bodyDir string) (string, error) {
+	target, err := replayURL(entry)
+	if err != nil {
+		target = entry.URL
+	}
+	if err := checkStoredRequestBody(entry); err != nil {
+		return "", err
+	}
+	var bodyFile string
+	if entry.RequestBodyFile != "" {
+		if bodyFile, err = bodyFilePath(bodyDir, entry.RequestBodyFile); err != nil {
+			return "", fmt.Errorf("request %w", err)
+		}
+	}
+
+	var b strings.Builder
+	body, decodeErr := decodeStoredBody(entry.RequestBody, entry.RequestBodyEncoding)
+	binaryBody := entry.RequestBodyEncoding == "base64" && decodeErr == nil && len(body) > 0
+	if binaryBody {
+		fmt.Fprintf(&b, "echo %s | base64 -d | ", shellQuote(entry.RequestBody))
+	}
+
+	fmt.Fprintf(&b, "curl -X %s %s", shellQuote(entry.Method), shellQuote(target))
+	for _, key := range sortedReplayHeaders(entry.RequestHeaders) {
+		for _, value := range requestHeaderValues(entry, key) {
+			fmt.Fprintf(&b, " \\\n  -H %s", shellQuote(key+": "+value))
+		}
+	}
+	switch {
+	case bodyFile != "":
+		fmt.Fprintf(&b, " \\\n  --data-binary %s", shellQuote("@"+bodyFile))
+	case binaryBody:
+		b.WriteString(" \\\n  --data-binary @-")
+	case entry.RequestBody != "":
+		fmt.Fprintf(&b, " \\\n  --data-binary %s", shellQuote(entry.RequestBody))
+	}
+	b.WriteString("\n")
+	return b.String(), nil
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// Replayer re-sends captured requests to their upstream.
+type Replayer struct {
+	// Transport is used for replayed requests. When nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+	// BodyDir is the -body-dir directory request bodies stored in files
+	// are read from.
+	BodyDir string
+
+	// proxy, when set, supplies the transport and body directory at each
+	// replay in place of Transport and BodyDir, so later changes to the
+	// proxy and its store are seen.
+	proxy *ProxyHandler
+}
+
+// ReplayResult summarizes the outcome of a replayed request.
+type ReplayResult struct {
+	ID             int64  `json:"id"`
+	Method         string `json:"method"`
+	URL            string `json:"url"`
+	Status         int    `json:"status,omitempty"`
+	DurationMillis int64  `json:"durationMillis"`
+	Error          string `json:"error,omitempty"`
+}
+
+// buildReplayRequest reconstructs the captured request, using the captured
+// method verbatim. A body stored in a file is read from bodyDir.
+func buildReplayRequest(ctx context.Context, entry LogEntryView, bodyDir string) (*http.Request, error) {
+	target, err := replayURL(entry)
+	if err != nil {
+		return nil, err
+	}
+	body, err := storedRequestBody(entry, bodyDir)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, entry.Method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range sortedReplayHeaders(entry.RequestHeaders) {
+		for _, value := range requestHeaderValues(entry, key) {
+			req.Header.Add(key, value)
+		}
+	}
+	return req, nil
+}
+
+// Replay re-sends entry and reports the response status and duration.
+// Upstream failures are reported in the result rather than as an error.
+func (p *Replayer) Replay(ctx context.Context, entry LogEntryView) (ReplayResult, error) {
+	var bodyDir string
+	transport := http.RoundTripper(http.DefaultTransport)
+	if p != nil {
+		bodyDir, transport = p.BodyDir, p.Transport
+		if p.proxy != nil {
+			bodyDir, transport = p.proxy.Store.BodyDir, p.proxy.Transport
+		}
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+	}
+	req, err := buildReplayRequest(ctx, entry, bodyDir)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+
+	result := ReplayResult{ID: entry.ID, Method: req.Method, URL: req.URL.String()}
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		result.Status = resp.StatusCode
+	}
+	result.DurationMillis = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// ReplayAll replays entries with at most concurrency requests in flight and
+// returns their results in the same order. Entries that cannot be replayed
+// are reported with an error.
+func (p *Replayer) ReplayAll(ctx context.Context, entries []LogEntryView, concurrency int) []ReplayResult {
+	results := make([]ReplayResult, len(entries))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(concurrency, len(entries)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				entry := entries[index]
+				result, err := p.Replay(ctx, entry)
+				if err != nil {
+					result = ReplayResult{ID: entry.ID, Method: entry.Method, URL: entry.UpstreamURL, Error: err.Error()}
+				}
+				results[index] = result
+			}
+		}()
+	}
+	for i := range entries {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+const (
+	defaultReplayConcurrency = 4
+	maxReplayConcurrency     = 64
+)
+
+// BulkReplaySummary reports the outcome of replaying several entries.
+type BulkReplaySummary struct {
+	Count          int            `json:"count"`
+	Errors         int            `json:"errors"`
+	Statuses       map[int]int    `json:"statuses"`
+	DurationMillis int64          `json:"durationMillis"`
+	Results        []ReplayResult `json:"results"`
+}
+
+// handleBulkReplay replays every stored entry, or those matching the filter
+// query parameter, and summarizes the results.
+func handleBulkReplay(store *LogStore, replayer *Replayer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodPost) {
+			return
+		}
+		concurrency := defaultReplayConcurrency
+		if value := r.URL.Query().Get("concurrency"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > maxReplayConcurrency {
+				http.Error(w, fmt.Sprintf("concurrency must be between 1 and %d", maxReplayConcurrency), http.StatusBadRequest)
+				return
+			}
+			concurrency = parsed
+		}
+
+		filter := strings.ToLower(r.URL.Query().Get("filter"))
+		var entries []LogEntryView
+		for _, entry := range store.List() {
+			if filter == "" || matchesReplayFilter(entry, filter) {
+				entries = append(entries, entry)
+			}
+		}
+
+		start := time.Now()
+		results := replayer.ReplayAll(r.Context(), entries, concurrency)
+		summary := BulkReplaySummary{
+			Count:          len(results),
+			Statuses:       make(map[int]int),
+			DurationMillis: time.Since(start).Milliseconds(),
+			Results:        results,
+		}
+		for _, result := range results {
+			if result.Error != "" {
+				summary.Errors++
+			} else {
+				summary.Statuses[result.Status]++
+			}
+		}
+		respondJSON(w, r, summary)
+	}
+}
+
+// matchesReplayFilter reports whether the lower-cased filter occurs in the
+// entry's method, URL, target or status, like the UI's search box.
+func matchesReplayFilter(entry LogEntryView, filter string) bool {
+	haystack := strings.ToLower(strings.Join([]string{entry.Method, entry.URL, entry.Target, strconv.Itoa(entry.Status)}, " "))
+	return strings.Contains(haystack, filter)
+}
+
+// serveStoredBody sends the raw request or response body of entry, chosen by
+// the side query parameter, as an attachment.
+func serveStoredBody(w http.ResponseWriter, r *http.Request, entry LogEntryView, bodyDir string) {
+	side := r.URL.Query().Get("side")
+	var body, encoding, contentType, file string
+	var truncated bool
+	switch side {
+	case "", "response":
+		side = "response"
+		if entry.ResponseBodyOmitted {
+			http.Error(w, "response body was not stored", http.StatusNotFound)
+			return
+		}
+		body, encoding, contentType, file = entry.ResponseBody, entry.ResponseBodyEncoding, entry.ResponseContentType, entry.ResponseBodyFile
+		truncated = entry.ResponseBodyTruncated
+	case "request":
+		body, encoding, contentType, file = entry.RequestBody, entry.RequestBodyEncoding, entry.RequestContentType, entry.RequestBodyFile
+		truncated = entry.RequestBodyTruncated
+	default:
+		http.Error(w, "side must be request or response", http.StatusBadRequest)
+		return
+	}
+	// Bodies in files are not counted against the budget, so they are
+	// never dropped.
+	if file == "" && entry.BodiesDropped {
+		http.Error(w, side+" body was dropped", http.StatusNotFound)
+		return
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if file != "" {
+		path, err := bodyFilePath(bodyDir, file)
+		if err != nil {
+			http.Error(w, side+" "+err.Error(), http.StatusNotFound)
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			http.Error(w, side+" body file is missing", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, "failed to read "+side+" body file", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%d", side, entry.ID))
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		_, _ = io.Copy(w, f)
+		return
+	}
+	data, err := decodeStoredBody(body, encoding)
+	if err != nil {
+		http.Error(w, "stored body is corrupt", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%d", side, entry.ID))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if truncated {
+		// The download holds only the captured prefix of the body.
+		w.Header().Set(truncatedHeader, "true")
+	}
+	_, _ = w.Write(data)
+}
+
+// storedRequestBody returns the captured request body of entry, reading it
+// from bodyDir when it was stored in a file.
+func storedRequestBody(entry LogEntryView, bodyDir string) ([]byte, error) {
+	if err := checkStoredRequestBody(entry); err != nil {
+		return nil, err
+	}
+	if entry.RequestBodyFile != "" {
+		path, err := bodyFilePath(bodyDir, entry.RequestBodyFile)
+		if err != nil {
+			return nil, fmt.Errorf("request %w", err)
+		}
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read request body file: %w", err)
+		}
+		return body, nil
+	}
+	body, err := decodeStoredBody(entry.RequestBody, entry.RequestBodyEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("decode request body: %w", err)
+	}
+	return body, nil
+}
+
+// checkStoredRequestBody reports an error when the captured request body of
+// entry is not the body that was sent, so that it is not sent again.
+func checkStoredRequestBody(entry LogEntryView) error {
+	hadBody := entry.RequestContentLength > 0
+	switch {
+	case entry.RequestBodyRedacted:
+		return errors.New("request body was redacted when it was captured")
+	case entry.RequestBodyFile != "":
+		return nil
+	case entry.RequestBodyTruncated:
+		return errors.New("request body was truncated when it was captured")
+	case len(entry.RequestParts) > 0:
+		return errors.New("multipart request body was only captured as a summary of its parts")
+	case hadBody && (entry.RequestBodySkipped || entry.BodyCaptureSkipped):
+		return errors.New("request body was not captured")
+	case hadBody && entry.BodiesDropped:
+		return errors.New("request body was dropped to stay within the body budget")
+	}
+	return nil
+}
+
+// bodyFilePath returns the path of the body file name in bodyDir. Names
+// writeBodyFile would not have chosen are refused, so imported entries
+// cannot point outside the directory.
+func bodyFilePath(bodyDir, name string) (string, error) {
+	if bodyDir == "" || !bodyFileName.MatchString(name) {
+		return "", errors.New("body file is not available")
+	}
+	return filepath.Join(bodyDir, name), nil
+}
+
+// decodeStoredBody reverses the encoding applied by formatBody.
+func decodeStoredBody(body, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+// handleLogStream streams completed entries over a WebSocket. Browsers do
+// not apply CORS to WebSockets, so the handshake is refused unless it comes
+// from the proxy's own origin or one of origins.
+func handleLogStream(store *LogStore, origins []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !webSocketOriginAllowed(r, origins) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+
+		updates, unsubscribe := store.Subscribe()
+		defer unsubscribe()
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			conn.readUntilClose()
+		}()
+
+		for {
+			select {
+			case view := <-updates:
+				payload, err := json.Marshal(view)
+				if err != nil {
+					continue
+				}
+				if err := conn.writeFrame(wsOpText, payload); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}
+}
+
+// requireMethod replies with 405 and returns false unless r uses one of the
+// given methods.
+func requireMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+type jsonIndentKey struct{}
+
+// jsonFormatMiddleware records whether respondJSON should indent its output:
+// yes unless compact is set, overridden per request by ?indent=true|false.
+func jsonFormatMiddleware(next http.Handler, compact bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		indent := !compact
+		if parsed, err := strconv.ParseBool(r.URL.Query().Get("indent")); err == nil {
+			indent = parsed
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jsonIndentKey{}, indent)))
+	})
+}
+
+// respondJSON writes value as JSON, indented unless jsonFormatMiddleware
+// chose compact output for r.
+func respondJSON(w http.ResponseWriter, r *http.Request, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if indent, ok := r.Context().Value(jsonIndentKey{}).(bool); !ok || indent {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// clientIP returns the address of the client that sent r. Forwarding headers
+// are only honored when the socket peer is one of the trusted proxies.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = host
+	}
+	if !ipInNets(peer, trusted) {
+		return peer
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		parts := strings.Split(forwarded, ",")
+		for i := len(parts) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(parts[i])
+			if hop != "" && (i == 0 || !ipInNets(hop, trusted)) {
+				return hop
+			}
+		}
+	}
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return realIP
+	}
+	return peer
+}
+
+func ipInNets(addr string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRList parses a comma-separated list of CIDR ranges. Bare IP
+// addresses are treated as single-host ranges.
+func ParseCIDRList(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", part)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", part)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func flattenHeaders(headers http.Header) map[string]string {
+	flat := make(map[string]string, len(headers))
+	for key, values := range headers {
+		flat[key] = strings.Join(values, ", ")
+	}
+	return flat
+}
+
+// dropTargetSignature removes X-Proxy-Target-Signature from captured
+// headers. A signature grants access to its target, so it is never logged.
+func dropTargetSignature(headers map[string]string, values map[string][]string) {
+	delete(headers, "X-Proxy-Target-Signature")
+	delete(values, "X-Proxy-Target-Signature")
+}
+
+// multiValueHeaders returns the headers that have more than one value, or
+// nil if there are none.
+func multiValueHeaders(headers http.Header) map[string][]string {
+	var multi map[string][]string
+	for key, values := range headers {
+		if len(values) > 1 {
+			if multi == nil {
+				multi = make(map[string][]string)
+			}
+			multi[key] = slices.Clone(values)
+		}
+	}
+	return multi
+}
+
+// respellHeaders renames the canonical keys of headers to their spelling
+// in names, which lists them as they appeared on the wire. Headers missing
+// from names keep their canonical form.
+func respellHeaders[V any](headers map[string]V, names []string) {
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(name)
+		if value, ok := headers[canonical]; ok && name != canonical {
+			delete(headers, canonical)
+			headers[name] = value
+		}
+	}
+}
+
+// requestHeaderValues returns the captured values of the request header
+// key, split into the individual values when it was sent more than once.
+func requestHeaderValues(entry LogEntryView, key string) []string {
+	if values, ok := entry.RequestHeaderValues[key]; ok {
+		return values
+	}
+	return []string{entry.RequestHeaders[key]}
+}
+
+// lookupHeader returns the value of name in flattened headers, whose keys
+// may not be in canonical form.
+func lookupHeader(headers map[string]string, name string) string {
+	if value, ok := headers[name]; ok {
+		return value
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+func cloneHeaderValues(source map[string][]string) map[string][]string {
+	if source == nil {
+		return nil
+	}
+	cloned := make(map[string][]string, len(source))
+	for key, values := range source {
+		cloned[key] = slices.Clone(values)
+	}
+	return cloned
+}
+
+func cloneMap(source map[string]string) map[string]string {
+	if source == nil {
+		return nil
+	}
+	cloned := make(map[string]string, len(source))
+	for key, value := range source {
+		cloned[key] = value
+	}
+	return cloned
+}
+
+func cloneValues(source url.Values) url.Values {
+	if source == nil {
+		return nil
+	}
+	cloned := make(url.Values, len(source))
+	for key, values := range source {
+		cloned[key] = append([]string(nil), values...)
+	}
+	return cloned
+}
+
+// bodyLanguage classifies a formatted body by its content type so the UI can
+// pick a highlighter.
+func bodyLanguage(contentType, encoding string) string {
+	if encoding == "base64" {
+		return "binary"
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "text/html", mediaType == "application/xhtml+xml":
+		return "html"
+	case mediaType == "application/json", mediaType == "text/json", strings.HasSuffix(mediaType, "+json"):
+		return "json"
+	case mediaType == "application/xml", mediaType == "text/xml", strings.HasSuffix(mediaType, "+xml"):
+		return "xml"
+	}
+	return "text"
+}
+
+// formatBody stores up to limit bytes of body as text, or as base64 when it
+// is not valid UTF-8. It also reports whether body was truncated.
+func formatBody(body []byte, limit int) (string, string, bool) {
+	truncated := false
+	if len(body) > limit {
+		body = body[:limit]
+		truncated = true
+	}
+
+	if utf8.Valid(body) {
+		return string(body), "utf-8", truncated
+	}
+
+	if truncated {
+		// If truncated, we might have split a multi-byte character.
+		// Try removing up to 3 bytes from the end to see if it becomes valid.
+		for i := 1; i <= 3 && len(body) > i; i++ {
+			sub := body[:len(body)-i]
+			if utf8.Valid(sub) {
+				return string(sub), "utf-8", truncated
+			}
+		}
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(body)
+	return encoded, "base64", truncated
+}
+
+var errNotMultipart = errors.New("not a multipart body")
+
+func parseMultipartParts(contentType string, body []byte) ([]MultipartPart, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, errNotMultipart
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var parts []MultipartPart
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		size, err := io.Copy(io.Discard, part)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, MultipartPart{
+			Name:        part.FormName(),
+			Filename:    part.FileName(),
+			ContentType: part.Header.Get("Content-Type"),
+			Size:        size,
+		})
+	}
+}
+
+// parseFormBody decodes an application/x-www-form-urlencoded body.
+func parseFormBody(contentType string, body []byte) (url.Values, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return nil, false
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, false
+	}
+	return form, true
+}
+
+// GraphQLOperation identifies the operation of a GraphQL request.
+type GraphQLOperation struct {
+	// Type is query, mutation or subscription.
+	Type string `json:"type"`
+	// Name is empty for anonymous operations.
+	Name string `json:"name,omitempty"`
+}
+
+// parseGraphQLOperation extracts the operation from a JSON GraphQL request
+// body with a query and optional operationName. When operationName is set,
+// the operation of that name is reported; otherwise the first one is.
+func parseGraphQLOperation(contentType string, body []byte) (*GraphQLOperation, bool) {
+	if bodyLanguage(contentType, "") != "json" {
+		return nil, false
+	}
+	var request struct {
+		Query         string `json:"query"`
+		OperationName string `json:"operationName"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil || strings.TrimSpace(request.Query) == "" {
+		return nil, false
+	}
+
+	operations := graphQLOperations(request.Query)
+	if len(operations) == 0 {
+		return nil, false
+	}
+	for i := range operations {
+		if request.OperationName != "" && operations[i].Name == request.OperationName {
+			return &operations[i], true
+		}
+	}
+	return &operations[0], true
+}
+
+// graphQLOperations lists the operations defined in a GraphQL document, in
+// order. Only top-level tokens are considered, so field and argument names
+// inside selection sets are never mistaken for keywords.
+func graphQLOperations(document string) []GraphQLOperation {
+	var operations []GraphQLOperation
+	depth := 0        // nesting of {} and ()
+	inHeader := false // between a definition keyword and its selection set
+	naming := false   // the next top-level name is the operation's name
+	for i := 0; i < len(document); {
+		c := document[i]
+		switch {
+		case c == '#':
+			for i < len(document) && document[i] != '\n' && document[i] != '\r' {
+				i++
+			}
+			continue
+		case c == '"':
+			i = skipGraphQLString(document, i)
+			continue
+		case c == '{' || c == '(':
+			if c == '{' && depth == 0 {
+				if !inHeader {
+					// The shorthand "{ ... }" form is an anonymous query.
+					operations = append(operations, GraphQLOperation{Type: "query"})
+				}
+				inHeader = false
+			}
+			naming = false
+			depth++
+		case c == '}' || c == ')':
+			depth = max(depth-1, 0)
+		case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+			start := i
+			for i < len(document) && isGraphQLNameChar(document[i]) {
+				i++
+			}
+			word := document[start:i]
+			if depth > 0 {
+				continue
+			}
+			switch {
+			case naming:
+				operations[len(operations)-1].Name = word
+				naming = false
+			case inHeader:
+			case word == "query" || word == "mutation" || word == "subscription":
+				operations = append(operations, GraphQLOperation{Type: word})
+				inHeader, naming = true, true
+			case word == "fragment":
+				inHeader = true
+			}
+			continue
+		}
+		i++
+	}
+	return operations
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+// skipGraphQLString returns the index just past the string literal or block
+// string starting at document[start].
+func skipGraphQLString(document string, start int) int {
+	if strings.HasPrefix(document[start:], `"""`) {
+		end := strings.Index(document[start+3:], `"""`)
+		if end < 0 {
+			return len(document)
+		}
+		return start + 3 + end + 3
+	}
+	for i := start + 1; i < len(document); i++ {
+		switch document[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(document)
+}
+
+// decodeResponseBody decompresses body for display, undoing the layers of
+// Content-Encoding from last to first. Decoding stops at the first layer that
+// is unsupported or fails, keeping what was decoded so far. It also returns
+// the encodings that were removed, in header order, or "" if the body is
+// returned as-is.
+func decodeResponseBody(headers http.Header, body []byte) ([]byte, string) {
+	if len(body) == 0 {
+		return body, ""
+	}
+
+	encodings := contentEncodings(headers)
+	var removed []string
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoded, err := decodeContentEncoding(encodings[i], body)
+		if err != nil {
+			break
+		}
+		body = decoded
+		if encodings[i] != "identity" {
+			removed = append([]string{encodings[i]}, removed...)
+		}
+	}
+
+	// Some targets gzip bodies without saying so.
+	if len(removed) == 0 && isGzipData(body) {
+		if decoded, err := gunzip(body); err == nil {
+			return decoded, "gzip"
+		}
+	}
+
+	return body, strings.Join(removed, ", ")
+}
+
+// contentEncodings returns the lower-cased Content-Encoding codings in the
+// order they were applied.
+func contentEncodings(headers http.Header) []string {
+	var encodings []string
+	for _, value := range headers.Values("Content-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			if encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding != "" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	return encodings
+}
+
+// decodeContentEncoding removes one layer of encoding from body. Brotli and
+// zstd have no decoder in the standard library and are reported as
+// unsupported.
+func decodeContentEncoding(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gunzip(body)
+	case "deflate":
+		return inflate(body)
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+func isGzipData(body []byte) bool {
+	return len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b
+}
+
+func gunzip(body []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// inflate decodes a deflate body. HTTP's deflate is zlib-wrapped, but some
+// servers send raw deflate data instead.
+func inflate(body []byte) ([]byte, error) {
+	if reader, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+		defer reader.Close()
+		if decoded, err := io.ReadAll(reader); err == nil {
+			return decoded, nil
+		}
+	}
+	reader := flate.NewReader(bytes.NewReader(body))
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+
+	wsMaxControlPayload = 125
+	wsGUID              = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// wsConn is a minimal server-side WebSocket connection (RFC 6455) that
+// supports pushing text messages and answering control frames.
+type wsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// webSocketOriginAllowed reports whether r has no Origin, an Origin whose
+// host is r.Host, or an Origin listed in origins.
+func webSocketOriginAllowed(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, candidate := range origins {
+		if candidate == "*" || strings.EqualFold(candidate, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("expected websocket upgrade")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("websocket not supported: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+	_, err = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept)
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length <= 125:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// readUntilClose consumes client frames, answering pings, until the client
+// closes the connection or a read fails.
+func (c *wsConn) readUntilClose() {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsOpClose:
+			_ = c.writeFrame(wsOpClose, payload)
+			return
+		case wsOpPing:
+			_ = c.writeFrame(wsOpPong, payload)
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if opcode >= wsOpClose && length <= wsMaxControlPayload {
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return 0, nil, err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		return opcode, payload, nil
+	}
+
+	// Data frames from the client are not used, so discard them.
+	if _, err := io.CopyN(io.Discard, c.reader, int64(length)); err != nil {
+		return 0, nil, err
+	}
+	return opcode, nil, nil
+}
+
+func headerContainsToken(headers http.Header, name, token string) bool {
+	for _, value := range headers.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			part, _, _ = strings.Cut(part, ";")
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func joinURLPath(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// normalizeURLPath collapses repeated slashes in u's path and resolves "."
+// and ".." segments. Percent-encoding in the path is preserved.
+func normalizeURLPath(u *url.URL) {
+	escaped := normalizePath(u.EscapedPath())
+	unescaped, err := url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+	u.Path = unescaped
+	u.RawPath = escaped
+}
+
+// normalizePath cleans p like path.Clean but keeps a trailing slash, so
+// "/a//b/../c/" becomes "/a/c/". An empty path stays empty.
+func normalizePath(p string) string {
+	if p == "" {
+		return p
+	}
+	cleaned := path.Clean("/" + p)
+	if cleaned != "/" && (strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..")) {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status code.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer for
+// flushing and hijacking.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// gzipResponseWriter compresses everything written through it. Compression
+// is skipped for responses without a body or that are already encoded.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	headers := w.Header()
+	if headers.Get("Content-Encoding") == "" {
+		// The compressed representation gets its own entity tag.
+		if etag := headers.Get("ETag"); etag != "" {
+			headers.Set("ETag", gzipETag(etag))
+		}
+	}
+	compressible := status != http.StatusNoContent && status != http.StatusNotModified && status != http.StatusPartialContent
+	if compressible && headers.Get("Content-Encoding") == "" {
+		headers.Del("Content-Length")
+		headers.Set("Content-Encoding", "gzip")
+		headers.Add("Vary", "Accept-Encoding")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.gz.Write(p)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// ParseContentTypeList splits a comma-separated list of content types.
+func ParseContentTypeList(value string) []string {
+	var types []string
+	for _, contentType := range strings.Split(value, ",") {
+		if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+			types = append(types, contentType)
+		}
+	}
+	return types
+}
+
+// ParseOriginList splits a comma-separated list of origins.
+func ParseOriginList(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// loopHeader lists the InstanceIDs of the proxies a request has passed
+// through.
+const loopHeader = "X-Proxymystuff-Instance"
+
+// truncatedHeader marks a body download that holds only the part of the body
+// captured before the capture limit.
+const truncatedHeader = "X-Proxymystuff-Truncated"
+
+// routeMiddleware decides between the admin routes registered on mux and
+// the proxy. Requests that name a target with X-Proxy-Target, ?target= or
+// a /proxy/ path always go to the proxy, even when their path is an admin
+// path such as /api/logs. Bypassing mux also keeps it from cleaning the
+// "//" out of /proxy/ targets. Other requests go to mux, where admin paths
+// take precedence over the default target. Requests this proxy forwarded
+// to itself are rejected with 508 so that they reach neither the admin
+// routes nor the proxy again.
+func routeMiddleware(mux http.Handler, proxy *ProxyHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withRawHeaderNames(r)
+		if proxy.InstanceID != "" && headerContainsToken(r.Header, loopHeader, proxy.InstanceID) {
+			http.Error(w, "request looped back to this proxy", http.StatusLoopDetected)
+			return
+		}
+		if r.Header.Get("X-Proxy-Target") != "" || r.URL.Query().Get("target") != "" || strings.HasPrefix(r.URL.Path, "/proxy/") {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// corsMiddleware allows the listed origins to call next from a browser and
+// answers their preflight requests. With no origins it does nothing.
+func corsMiddleware(next http.Handler, origins []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(origins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := false
+		for _, candidate := range origins {
+			if candidate == "*" || strings.EqualFold(candidate, origin) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			allowHeaders := r.Header.Get("Access-Control-Request-Headers")
+			if allowHeaders == "" {
+				allowHeaders = "Content-Type, If-None-Match"
+			}
+			w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipETagSuffix marks the entity tags of gzip representations.
+const gzipETagSuffix = "-gzip"
+
+// gzipETag returns the entity tag of the gzip representation of the
+// response tagged etag.
+func gzipETag(etag string) string {
+	if !strings.HasSuffix(etag, `"`) || strings.HasSuffix(etag, gzipETagSuffix+`"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + gzipETagSuffix + `"`
+}
+
+// acceptsGzip reports whether header's Accept-Encoding allows gzip. A gzip
+// entry takes precedence over "*", and a q-value of 0 refuses the coding.
+func acceptsGzip(header http.Header) bool {
+	gzipQ, wildcardQ := -1.0, -1.0
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				name, qValue, ok := strings.Cut(param, "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(name), "q") {
+					continue
+				}
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(qValue), 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+			switch strings.ToLower(strings.TrimSpace(coding)) {
+			case "gzip", "x-gzip":
+				gzipQ = q
+			case "*":
+				wildcardQ = q
+			}
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return wildcardQ > 0
+}
+
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r.Header) || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") != "" {
+			// Handlers compare against the tag of the identity
+			// representation.
+			r = r.Clone(r.Context())
+			values := r.Header.Values("If-None-Match")
+			for i, value := range values {
+				values[i] = strings.ReplaceAll(value, gzipETagSuffix+`"`, `"`)
+			}
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+type accessLogRecord struct {
+	Time           time.Time `json:"time"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	Status         int       `json:"status"`
+	DurationMillis float64   `json:"durationMillis"`
+	ClientIP       string    `json:"clientIp"`
+	Proto          string    `json:"proto"`
+}
+
+var jsonAccessLog = log.New(os.Stderr, "", 0)
+
+func LoggingMiddleware(next http.Handler, format string, trusted []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		duration := time.Since(start)
+
+		if format == "json" {
+			line, err := json.Marshal(accessLogRecord{
+				Time:           start,
+				Method:         r.Method,
+				Path:           r.URL.Path,
+				Status:         recorder.Status(),
+				DurationMillis: float64(duration.Microseconds()) / 1000,
+				ClientIP:       clientIP(r, trusted),
+				Proto:          r.Proto,
+			})
+			if err == nil {
+				jsonAccessLog.Print(string(line))
+				return
+			}
+		}
+		log.Printf("%s %s %d %s", r.Method, r.URL.Path, recorder.Status(), duration)
+	})
+}
@@ -13,14 +13,21 @@ let selectedId = null;
 let refreshTimer = null;
 let lastLogsJson = "";
 let expandedSections = new Set();
+let liveSocket = null;
+let logsEtag = "";
 
 const fetchLogs = async () => {
   try {
-    const response = await fetch("/api/logs");
+    const headers = logsEtag ? { "If-None-Match": logsEtag } : {};
+    const response = await fetch("/api/logs?indent=false", { headers });
+    if (response.status === 304) {
+      return;
+    }
     if (!response.ok) {
       logList.innerHTML = "<p class='error'>Failed to fetch logs.</p>";
       return;
     }
+    logsEtag = response.headers.get("ETag") || "";
     const data = await response.json();
     const dataJson = JSON.stringify(data);
     
@@ -45,10 +52,52 @@ const fetchLogs = async () => {
   }
 };
 
+const upsertLog = (entry) => {
+  const index = logs.findIndex((existing) => existing.id === entry.id);
+  if (index >= 0) {
+    logs[index] = entry;
+  } else {
+    logs.unshift(entry);
+  }
+  lastLogsJson = "";
+
+  updateFilters(logs);
+  renderList();
+  if (selectedId === entry.id) {
+    renderDetails(entry);
+  }
+};
+
+const connectLiveFeed = () => {
+  const protocol = window.location.protocol === "https:" ? "wss:" : "ws:";
+  const socket = new WebSocket(`${protocol}//${window.location.host}/api/logs/ws`);
+  socket.addEventListener("open", () => {
+    liveSocket = socket;
+    fetchLogs();
+    scheduleAutoRefresh();
+  });
+  socket.addEventListener("message", (event) => {
+    if (!autoRefresh.checked) return;
+    try {
+      upsertLog(JSON.parse(event.data));
+    } catch (err) {
+      console.error("Live feed error:", err);
+    }
+  });
+  socket.addEventListener("close", () => {
+    const wasOpen = liveSocket === socket;
+    liveSocket = null;
+    scheduleAutoRefresh();
+    if (wasOpen) {
+      setTimeout(connectLiveFeed, 5000);
+    }
+  });
+};
+
 const renderList = () => {
   const filtered = applyFilters(logs);
   
-  const currentListState = JSON.stringify(filtered.map(e => ({id: e.id, status: e.status, method: e.method, url: e.url})));
+  const currentListState = JSON.stringify(filtered.map(e => ({id: e.id, status: e.status, method: e.method, url: e.url, pinned: e.pinned})));
   if (logList.dataset.state === currentListState && logList.dataset.selected === String(selectedId)) {
     return;
   }
@@ -71,8 +120,9 @@ const renderList = () => {
       <div class="log-entry__meta">
         <span class="method">${entry.method}</span>
         <span class="status">${entry.status || "-"}</span>
+        ${entry.pinned ? `<span class="pinned">pinned</span>` : ""}
       </div>
-      <div class="log-entry__url">${entry.url}</div>
+      <div class="log-entry__url">${entry.url}${renderGraphQLOperation(entry)}</div>
       <div class="log-entry__time">${new Date(entry.startedAt).toLocaleTimeString()}</div>
     `;
     item.addEventListener("click", () => {
@@ -106,8 +156,16 @@ const renderDetails = (entry) => {
   details.innerHTML = `
     <div class="detail-header">
       <h2>${entry.method} ${entry.url}</h2>
-      <p>Target: <span>${entry.target || "Not resolved"}</span></p>
+      <p>Target: <span>${entry.target || "Not resolved"}</span>${entry.resolutionMethod ? ` (by ${entry.resolutionMethod})` : ""}</p>
       <p>Status: <strong>${entry.status || "Pending"}</strong> Duration: ${entry.durationMillis} ms</p>
+      ${renderTimings(entry)}
+      ${renderSchemaErrors(entry)}
+      ${renderUpstreamTLS(entry)}
+      <div class="note-bar">
+        <input id="note-input" type="text" placeholder="Add a note" value="${escapeHtml(entry.note || "").replace(/"/g, "&quot;")}" />
+        <button id="save-note" type="button">Save note</button>
+        <button id="toggle-pin" type="button">${entry.pinned ? "Unpin" : "Pin"}</button>
+      </div>
     </div>
     <div class="detail-grid">
       <div class="detail-section">
@@ -121,9 +179,10 @@ const renderDetails = (entry) => {
             ${isJson(entry.requestBody) ? `<button class="pretty-print-btn" data-target="request-body" data-type="request">Pretty print</button>` : ""}
           </div>
           <div id="request-headers" class="header-table ${expandedSections.has("request-headers") ? "" : "is-collapsed"}">
-            ${renderHeaderTable(entry.requestHeaders)}
+            ${renderHeaderTable(entry.requestHeaders, entry.requestHeaderValues)}
           </div>
-          ${renderBody(entry.requestBody, entry.requestBodyEncoding, entry.requestBodyTruncated, "request-body")}
+          ${entry.requestForm ? renderFormTable(entry.requestForm) : ""}
+          ${entry.requestParts ? renderPartsTable(entry.requestParts) : renderBody(entry.requestBody, entry.requestBodyEncoding, entry.requestBodyTruncated, "request-body", "", `/api/logs/${entry.id}/download?side=request`, entry.requestBodyFile)}
         </div>
       </div>
       <div class="detail-section">
@@ -136,15 +195,35 @@ const renderDetails = (entry) => {
             ${isJson(entry.responseBody) ? `<button class="pretty-print-btn" data-target="response-body" data-type="response">Pretty print</button>` : ""}
           </div>
           <div id="response-headers" class="header-table ${expandedSections.has("response-headers") ? "" : "is-collapsed"}">
-            ${renderHeaderTable(entry.responseHeaders)}
+            ${renderHeaderTable(entry.responseHeaders, entry.responseHeaderValues)}
           </div>
-          ${renderBody(entry.responseBody, entry.responseBodyEncoding, entry.responseBodyTruncated, "response-body")}
+          ${renderBody(entry.responseBody, entry.responseBodyEncoding, entry.responseBodyTruncated, "response-body", entry.responseBodyOriginalEncoding, `/api/logs/${entry.id}/download?side=response`, entry.responseBodyFile)}
         </div>
       </div>
     </div>
     ${entry.error ? `<div class="error-box">Error: ${entry.error}</div>` : ""}
   `;
 
+  const saveNote = document.getElementById("save-note");
+  saveNote.addEventListener("click", async () => {
+    const note = document.getElementById("note-input").value;
+    const response = await fetch(`/api/logs/${entry.id}/note`, {
+      method: "PUT",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ note }),
+    });
+    if (response.ok) {
+      upsertLog(await response.json());
+    }
+  });
+
+  document.getElementById("toggle-pin").addEventListener("click", async () => {
+    const response = await fetch(`/api/logs/${entry.id}/pin`, { method: entry.pinned ? "DELETE" : "POST" });
+    if (response.ok) {
+      upsertLog(await response.json());
+    }
+  });
+
   details.querySelectorAll(".header-toggle").forEach((button) => {
     button.addEventListener("click", () => {
       const targetId = button.dataset.target;
@@ -198,26 +277,96 @@ const renderHeaderToggle = (sectionId) => {
   `;
 };
 
-const renderHeaderTable = (headers) => {
+// Headers sent more than once get a row per value from multiValues.
+const renderHeaderTable = (headers, multiValues = {}) => {
   if (!headers || Object.keys(headers).length === 0) {
     return "<p class='placeholder'>No headers captured.</p>";
   }
   const rows = Object.entries(headers)
-    .map(([key, value]) => `<tr><th>${key}</th><td>${value}</td></tr>`)
+    .flatMap(([key, value]) => (multiValues?.[key] || [value]).map((v) => `<tr><th>${escapeHtml(key)}</th><td>${escapeHtml(v)}</td></tr>`))
     .join("");
   return `<table class='headers'>${rows}</table>`;
 };
 
-const renderBody = (body, encoding, truncated, id) => {
+const renderFormTable = (form) => {
+  const rows = Object.entries(form)
+    .flatMap(([key, values]) => values.map((value) => `<tr><th>${escapeHtml(key)}</th><td>${escapeHtml(value)}</td></tr>`))
+    .join("");
+  return `
+    <div class="body-block">
+      <div class="body-meta">Form fields</div>
+      <table class='headers'>${rows}</table>
+    </div>
+  `;
+};
+
+const renderPartsTable = (parts) => {
+  const rows = parts
+    .map((part) => `<tr><th>${escapeHtml(part.name)}</th><td>${part.filename ? escapeHtml(part.filename) : ""}</td><td>${escapeHtml(part.contentType || "")}</td><td>${part.size} bytes</td></tr>`)
+    .join("");
+  return `
+    <div class="body-block">
+      <div class="body-meta">Multipart form</div>
+      <table class='headers'>${rows}</table>
+    </div>
+  `;
+};
+
+const renderGraphQLOperation = (entry) => {
+  const operation = entry.graphqlOperation;
+  if (!operation) {
+    return "";
+  }
+  return ` <span class="graphql-operation">${operation.type} ${escapeHtml(operation.name || "(anonymous)")}</span>`;
+};
+
+const renderTimings = (entry) => {
+  const phases = [
+    ["DNS", entry.dnsMillis],
+    ["Connect", entry.connectMillis],
+    ["TLS", entry.tlsHandshakeMillis],
+  ].filter(([, millis]) => millis);
+  if (phases.length === 0) {
+    return "";
+  }
+  return `<p>${phases.map(([label, millis]) => `${label}: ${millis.toFixed(1)} ms`).join(" ")}</p>`;
+};
+
+const renderUpstreamTLS = (entry) => {
+  const upstream = entry.upstreamTls;
+  if (!upstream) {
+    return "";
+  }
+  const chain = (upstream.certificates || []).map((cert) =>
+    `${escapeHtml(cert.subject)} (issued by ${escapeHtml(cert.issuer)}, expires ${new Date(cert.notAfter).toLocaleDateString()})`);
+  const error = upstream.error ? ` <span class="schema-error">${escapeHtml(upstream.error)}</span>` : "";
+  return `<p>TLS: ${upstream.version || ""} ${chain.join(" &larr; ")}${error}</p>`;
+};
+
+const renderSchemaErrors = (entry) => {
+  if (!entry.schemaErrors || entry.schemaErrors.length === 0) {
+    return "";
+  }
+  return entry.schemaErrors.map((error) => `<p class="schema-error">Schema: ${escapeHtml(error)}</p>`).join("");
+};
+
+const renderBody = (body, encoding, truncated, id, decodedFrom, downloadUrl, file) => {
+  if (file) {
+    return `<div class="body-block"><div class="body-meta">Body stored in ${escapeHtml(file)} <a href="${downloadUrl}">Download</a></div></div>`;
+  }
   if (!body) {
     return "<p class='placeholder'>No body captured.</p>";
   }
   const note = truncated ? "<span class='truncated'>truncated</span>" : "";
-  const label = encoding === "base64" ? "(base64)" : "";
+  const label = [
+    encoding === "base64" ? "(base64)" : "",
+    decodedFrom ? `(decoded from ${decodedFrom})` : "",
+  ].join(" ");
+  const download = encoding === "base64" ? `<a href="${downloadUrl}">Download</a>` : "";
   const safeBody = escapeHtml(body);
   return `
     <div class="body-block">
-      <div class="body-meta">Body ${label} ${note}</div>
+      <div class="body-meta">Body ${label} ${note} ${download}</div>
       <textarea id="${id}" class="body-text" rows="10" readonly>${safeBody}</textarea>
     </div>
   `;
@@ -278,13 +427,15 @@ const applyFilters = (entries) => {
 
 const scheduleAutoRefresh = () => {
   if (refreshTimer) clearInterval(refreshTimer);
-  if (autoRefresh.checked) {
+  refreshTimer = null;
+  if (autoRefresh.checked && !liveSocket) {
     refreshTimer = setInterval(fetchLogs, 2000);
   }
 };
 
 refreshButton.addEventListener("click", () => {
   lastLogsJson = ""; // Force re-render
+  logsEtag = "";
   fetchLogs();
 });
 searchInput.addEventListener("input", renderList);
@@ -292,7 +443,11 @@ methodFilter.addEventListener("change", renderList);
 statusFilter.addEventListener("change", renderList);
 startTimeInput.addEventListener("change", renderList);
 endTimeInput.addEventListener("change", renderList);
-autoRefresh.addEventListener("change", scheduleAutoRefresh);
+autoRefresh.addEventListener("change", () => {
+  if (autoRefresh.checked) fetchLogs();
+  scheduleAutoRefresh();
+});
 
 fetchLogs();
 scheduleAutoRefresh();
+connectLiveFeed();